@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -15,6 +16,7 @@ import (
 	"github.com/johnewart/subcommands"
 	ybconfig "github.com/yourbase/yb/config"
 	"github.com/yourbase/yb/plumbing/log"
+	"github.com/yourbase/yb/plumbing/redact"
 	"github.com/yourbase/yb/workspace"
 )
 
@@ -27,6 +29,10 @@ type BuildCmd struct {
 	NoContainer      bool
 	DependenciesOnly bool
 	CleanBuild       bool
+	Jobs             int
+	Environment      string
+	DryRun           bool
+	JSON             bool
 }
 
 type BuildLog struct {
@@ -42,9 +48,13 @@ func (*BuildCmd) Usage() string {
 
 func (b *BuildCmd) SetFlags(f *flag.FlagSet) {
 	f.BoolVar(&b.NoContainer, "no-container", false, "Bypass container even if specified")
-	f.BoolVar(&b.DependenciesOnly, "deps-only", false, "Install only dependencies, don't do anything else")
+	f.BoolVar(&b.DependenciesOnly, "deps-only", false, "Install only dependencies, don't do anything else, and leave the build container running")
 	f.StringVar(&b.ExecPrefix, "exec-prefix", "", "Add a prefix to all executed commands (useful for timing or wrapping things)")
 	f.BoolVar(&b.CleanBuild, "clean", false, "Perform a completely clean build -- don't reuse anything when building")
+	f.IntVar(&b.Jobs, "j", 1, "Number of independent build targets to run in parallel")
+	f.StringVar(&b.Environment, "e", workspace.DefaultEnvironment, "Environment to build targets with")
+	f.BoolVar(&b.DryRun, "dry-run", false, "Print what would be built, and how, without building anything")
+	f.BoolVar(&b.JSON, "json", false, "Print the -dry-run plan as JSON")
 }
 
 func (b *BuildCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -82,22 +92,34 @@ func (b *BuildCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{
 		}
 	}
 
-	var targetTimers []workspace.TargetTimer
-
 	buildFlags := workspace.BuildFlags{
 		HostOnly:         b.NoContainer,
 		CleanBuild:       b.CleanBuild,
 		ExecPrefix:       b.ExecPrefix,
 		DependenciesOnly: b.DependenciesOnly,
+		Jobs:             b.Jobs,
+		Environment:      b.Environment,
 	}
-	stepTimers, buildError := pkg.Build(ctx, buildFlags, target)
 
-	if err != nil {
-		log.Errorf("Failed to build target package: %v\n", err)
-		return subcommands.ExitFailure
+	if b.DryRun {
+		plan, err := pkg.Plan(buildFlags, target)
+		if err != nil {
+			log.Errorf("Unable to plan build: %v", err)
+			return subcommands.ExitFailure
+		}
+		if b.JSON {
+			err = printBuildPlanJSON(os.Stdout, plan)
+		} else {
+			err = printBuildPlan(os.Stdout, plan)
+		}
+		if err != nil {
+			log.Errorf("Unable to print build plan: %v", err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
 	}
 
-	targetTimers = append(targetTimers, workspace.TargetTimer{Name: pkg.Name, Timers: stepTimers})
+	targetTimers, buildError := pkg.Build(ctx, buildFlags, target)
 
 	endTime := time.Now()
 	buildTime := endTime.Sub(startTime)
@@ -106,19 +128,7 @@ func (b *BuildCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{
 	log.Info("")
 	log.Infof("Build finished at %s, taking %s", endTime.Format(TIME_FORMAT), buildTime)
 	log.Info("")
-	log.Infof("%15s%15s%15s%24s   %s", "Start", "End", "Elapsed", "Target", "Command")
-	for _, timer := range targetTimers {
-		for _, step := range timer.Timers {
-			elapsed := step.EndTime.Sub(step.StartTime).Truncate(time.Microsecond)
-			log.Infof("%15s%15s%15s%24s   %s",
-				step.StartTime.Format(TIME_FORMAT),
-				step.EndTime.Format(TIME_FORMAT),
-				elapsed,
-				timer.Name,
-				step.Command)
-		}
-	}
-	log.Infof("%15s%15s%15s   %s", "", "", buildTime.Truncate(time.Millisecond), "TOTAL")
+	logBuildTimers(targetTimers, buildTime)
 
 	if buildError != nil {
 		log.SubSection("BUILD FAILED")
@@ -177,6 +187,90 @@ func (b *BuildCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{
 	return subcommands.ExitSuccess
 }
 
+// logBuildTimers logs a table of every command run for each target and how
+// long it took.
+func logBuildTimers(targetTimers []workspace.TargetTimer, buildTime time.Duration) {
+	log.Infof("%15s%15s%15s%24s   %s", "Start", "End", "Elapsed", "Target", "Command")
+	for _, timer := range targetTimers {
+		for _, step := range timer.Timers {
+			elapsed := step.EndTime.Sub(step.StartTime).Truncate(time.Microsecond)
+			log.Infof("%15s%15s%15s%24s   %s",
+				step.StartTime.Format(TIME_FORMAT),
+				step.EndTime.Format(TIME_FORMAT),
+				elapsed,
+				timer.Name,
+				step.Command)
+		}
+	}
+	log.Infof("%15s%15s%15s   %s", "", "", buildTime.Truncate(time.Millisecond), "TOTAL")
+}
+
+func printBuildPlanJSON(w io.Writer, plan workspace.BuildPlan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
+
+func printBuildPlan(w io.Writer, plan workspace.BuildPlan) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "Build plan for %s:%s in environment %s (%d parallel job(s))\n", plan.Package, plan.Target, plan.Environment, plan.Jobs)
+
+	for i, tgt := range plan.Targets {
+		fmt.Fprintf(bw, "\n%d. %s", i+1, tgt.Name)
+		if tgt.UpToDate {
+			fmt.Fprint(bw, " (up to date, will be skipped)")
+		}
+		fmt.Fprintln(bw)
+		if len(tgt.BuildAfter) > 0 {
+			fmt.Fprintf(bw, "   After:       %s\n", strings.Join(tgt.BuildAfter, ", "))
+		}
+		if len(tgt.Tools) > 0 {
+			fmt.Fprintf(bw, "   Tools:       %s\n", strings.Join(tgt.Tools, ", "))
+		}
+		switch {
+		case tgt.Container != nil:
+			fmt.Fprintf(bw, "   Runs in:     container %s\n", tgt.Container.Image)
+			printList(bw, "   Mounts:      ", tgt.Container.Mounts)
+			printList(bw, "   Ports:       ", tgt.Container.Ports)
+		case tgt.Sandboxed:
+			fmt.Fprintln(bw, "   Runs in:     host sandbox")
+		default:
+			fmt.Fprintln(bw, "   Runs in:     host")
+		}
+		fmt.Fprintf(bw, "   Work dir:    %s\n", tgt.WorkDir)
+		printList(bw, "   Environment: ", tgt.Environment)
+		if len(tgt.Secrets) > 0 {
+			fmt.Fprintf(bw, "   Secrets:     %s\n", strings.Join(tgt.Secrets, ", "))
+		}
+		for _, dep := range tgt.Dependencies {
+			fmt.Fprintf(bw, "   Dependency:  %s (%s)\n", dep.Label, dep.Image)
+			printList(bw, "     Mounts:    ", dep.Mounts)
+			printList(bw, "     Ports:     ", dep.Ports)
+			printList(bw, "     Env:       ", dep.Environment)
+		}
+		printList(bw, "   Commands:    ", tgt.Commands)
+		if len(tgt.Artifacts) > 0 {
+			fmt.Fprintf(bw, "   Artifacts:   %s -> %s\n", strings.Join(tgt.Artifacts, ", "), tgt.OutputDir)
+		}
+		printList(bw, "   Warning:     ", tgt.Warnings)
+	}
+
+	return bw.Flush()
+}
+
+// printList prints the first item after label and lines up the others below
+// it.
+func printList(w io.Writer, label string, items []string) {
+	indent := strings.Repeat(" ", len(label))
+	for i, item := range items {
+		if i == 0 {
+			fmt.Fprintf(w, "%s%s\n", label, item)
+		} else {
+			fmt.Fprintf(w, "%s%s\n", indent, item)
+		}
+	}
+}
+
 func parseArgs(lonelyArg string) (pkgName, target string, err error) {
 	if strings.HasPrefix(lonelyArg, "@") {
 		// Parse package lonelyArg and target lonelyArg
@@ -199,7 +293,7 @@ func parseArgs(lonelyArg string) (pkgName, target string, err error) {
 func UploadBuildLogsToAPI(buf *bytes.Buffer) {
 	log.Infof("Uploading build logs...")
 	buildLog := BuildLog{
-		Contents: buf.String(),
+		Contents: redact.String(buf.String()),
 	}
 	jsonData, _ := json.Marshal(buildLog)
 	resp, err := postJsonToApi("/buildlogs", jsonData)
@@ -0,0 +1,143 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/johnewart/subcommands"
+	"gopkg.in/src-d/go-git.v4"
+
+	"github.com/yourbase/yb/plumbing/log"
+	"github.com/yourbase/yb/workspace"
+)
+
+type CICmd struct {
+}
+
+func (*CICmd) Name() string     { return "ci" }
+func (*CICmd) Synopsis() string { return "CI-related commands" }
+func (*CICmd) Usage() string {
+	return `ci <subcommand>`
+}
+
+func (c *CICmd) SetFlags(f *flag.FlagSet) {}
+
+func (c *CICmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	cmdr := subcommands.NewCommander(f, "ci")
+	cmdr.Register(&ciRunCmd{}, "")
+	return (cmdr.Execute(ctx))
+}
+
+type ciRunCmd struct {
+	Branch      string
+	Action      string
+	Tag         string
+	Environment string
+	NoContainer bool
+	Jobs        int
+}
+
+func (*ciRunCmd) Name() string { return "run" }
+func (*ciRunCmd) Synopsis() string {
+	return "Build the CI builds whose conditions match the local branch and a simulated event"
+}
+func (*ciRunCmd) Usage() string {
+	return `run [name]`
+}
+
+func (c *ciRunCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.Branch, "branch", "", "Branch to simulate, defaults to the branch checked out in the package")
+	f.StringVar(&c.Action, "action", "push", "Action that triggered the simulated build, e.g. push or pull_request")
+	f.StringVar(&c.Tag, "tag", "", "Simulate a build for this tag")
+	f.StringVar(&c.Environment, "e", workspace.DefaultEnvironment, "Environment to build targets with")
+	f.BoolVar(&c.NoContainer, "no-container", false, "Bypass container even if specified")
+	f.IntVar(&c.Jobs, "j", 1, "Number of independent build targets to run in parallel")
+}
+
+func (c *ciRunCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	ws, err := workspace.LoadWorkspace()
+	if err != nil {
+		log.Errorf("Error loading workspace: %v", err)
+		return subcommands.ExitFailure
+	}
+	pkg, err := ws.TargetPackage()
+	if err != nil {
+		log.Errorf("Unable to find default package: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	builds := pkg.Manifest.CI.CIBuilds
+	if f.NArg() > 0 {
+		build, err := pkg.Manifest.CIBuild(f.Arg(0))
+		if err != nil {
+			log.Errorf("%v", err)
+			return subcommands.ExitFailure
+		}
+		builds = []workspace.CIBuild{build}
+	}
+	if len(builds) == 0 {
+		log.Errorf("No CI builds defined in the build manifest of %s", pkg.Name)
+		return subcommands.ExitFailure
+	}
+
+	event := workspace.CIEvent{Branch: c.Branch, Action: c.Action, Tag: c.Tag}
+	if event.Branch == "" {
+		repo, err := git.PlainOpenWithOptions(pkg.Path(), &git.PlainOpenOptions{DetectDotGit: true})
+		if err != nil {
+			log.Errorf("Unable to open git repository of %s, use -branch to set the branch: %v", pkg.Name, err)
+			return subcommands.ExitFailure
+		}
+		event.Branch, err = defineBranch(repo, "")
+		if err != nil {
+			log.Errorf("Unable to determine the current branch, use -branch to set it: %v", err)
+			return subcommands.ExitFailure
+		}
+	}
+	log.Infof("Simulating %s on branch %s", eventDescription(event), event.Branch)
+
+	matching := make([]workspace.CIBuild, 0)
+	for _, build := range builds {
+		ok, err := build.Matches(event)
+		if err != nil {
+			log.Errorf("%v", err)
+			return subcommands.ExitFailure
+		}
+		if ok {
+			log.Infof("  %-20s runs (target %s)", build.Name, build.BuildTarget)
+			matching = append(matching, build)
+		} else {
+			log.Infof("  %-20s skipped (when: %s)", build.Name, build.When)
+		}
+	}
+
+	buildFlags := workspace.BuildFlags{
+		HostOnly:    c.NoContainer,
+		Jobs:        c.Jobs,
+		Environment: c.Environment,
+	}
+	for _, build := range matching {
+		log.SubSection(fmt.Sprintf("CI build %s", build.Name))
+		startTime := time.Now()
+		targetTimers, err := pkg.Build(ctx, buildFlags, build.BuildTarget)
+		logBuildTimers(targetTimers, time.Since(startTime))
+		if err != nil {
+			log.SubSection("BUILD FAILED")
+			log.Errorf("CI build %s failed: %v", build.Name, err)
+			return subcommands.ExitFailure
+		}
+	}
+
+	if len(matching) > 0 {
+		log.SubSection("BUILD SUCCEEDED")
+	}
+	return subcommands.ExitSuccess
+}
+
+func eventDescription(event workspace.CIEvent) string {
+	if event.Tag != "" {
+		return fmt.Sprintf("%s of tag %s", event.Action, event.Tag)
+	}
+	return event.Action
+}
@@ -5,11 +5,15 @@ import (
 	"flag"
 	"github.com/johnewart/subcommands"
 	"github.com/yourbase/yb/plumbing/log"
+	"github.com/yourbase/yb/runtime"
 	"github.com/yourbase/yb/workspace"
 )
 
 type ExecCmd struct {
 	environment string
+	saveLogs    bool
+	skipBuild   bool
+	watch       bool
 }
 
 func (*ExecCmd) Name() string { return "exec" }
@@ -22,10 +26,14 @@ func (*ExecCmd) Usage() string {
 
 func (p *ExecCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.environment, "e", "", "Environment to run as")
+	f.BoolVar(&p.saveLogs, "save-logs", false, "Copy the exec log files into the build root when exec exits")
+	f.BoolVar(&p.skipBuild, "skip-build", false, "Don't build the build_first targets before executing")
+	f.BoolVar(&p.watch, "watch", false, "Restart the exec commands when files in the package change, polling the package tree every 500ms")
 }
 
 /*
 Executing the target involves:
+0. Build the build_first targets, unless skipped
 1. Map source into the target container
 2. Run any dependent components
 3. Start target
@@ -54,7 +62,15 @@ func (b *ExecCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}
 		}
 	}
 
-	err = ws.ExecutePackage(ctx, pkg)
+	err = ws.ExecutePackage(ctx, pkg, workspace.ExecFlags{
+		SaveLogs:  b.saveLogs,
+		SkipBuild: b.skipBuild,
+		Watch:     b.watch,
+	})
+	if runErr, ok := err.(*runtime.TargetRunError); ok {
+		log.Errorf("%v", runErr)
+		return subcommands.ExitStatus(runErr.ExitCode)
+	}
 	if err != nil {
 		log.Errorf("Unable to run '%s': %v", pkg.Name, err)
 		return subcommands.ExitFailure
@@ -107,7 +107,7 @@ func (d *DockerArchiveCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...in
 		Command: instructions.Docker.Exec,
 	}
 
-	tmpArchiveFile := filepath.Join(d.targetPackage.Path(), fmt.Sprintf("%s-package.tar", d.targetPackage.Name))
+	tmpArchiveFile := filepath.Join(d.targetPackage.Path(), fmt.Sprintf("%s-package.tar", filepath.Base(d.targetPackage.Name)))
 	tar := archiver.Tar{MkdirAll: true}
 	err := tar.Archive(instructions.Artifacts, tmpArchiveFile)
 	if err != nil {
@@ -151,7 +151,7 @@ func (t *TarArchiveCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interfa
 	if t.tar_file == "" {
 		outputDir := filepath.Join(t.targetPackage.BuildRoot(), "output")
 		MkdirAsNeeded(outputDir)
-		archiveFile := fmt.Sprintf("%s-package.tar", t.targetPackage.Name)
+		archiveFile := fmt.Sprintf("%s-package.tar", filepath.Base(t.targetPackage.Name))
 		t.tar_file = filepath.Join(outputDir, archiveFile)
 	}
 
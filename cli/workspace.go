@@ -1,19 +1,20 @@
 package cli
 
 import (
-	"bufio"
 	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/johnewart/subcommands"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
-	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 
 	"github.com/yourbase/narwhal"
 	"github.com/yourbase/yb/plumbing/log"
@@ -38,6 +39,9 @@ func (w *WorkspaceCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interf
 	cmdr.Register(&workspaceTargetCmd{}, "")
 	cmdr.Register(&workspaceLocationCmd{}, "")
 	cmdr.Register(&workspaceListCmd{}, "")
+	cmdr.Register(&workspaceStatusCmd{}, "")
+	cmdr.Register(&workspaceSyncCmd{}, "")
+	cmdr.Register(&workspaceLockCmd{}, "")
 	return (cmdr.Execute(ctx))
 }
 
@@ -96,6 +100,230 @@ func (w *workspaceListCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...in
 	return subcommands.ExitSuccess
 }
 
+// STATUS
+type workspaceStatusCmd struct{}
+
+func (*workspaceStatusCmd) Name() string { return "status" }
+func (*workspaceStatusCmd) Synopsis() string {
+	return "Show the branch and state of every repository's checkout"
+}
+func (*workspaceStatusCmd) Usage() string {
+	return `status`
+}
+
+func (w *workspaceStatusCmd) SetFlags(f *flag.FlagSet) {}
+
+func (w *workspaceStatusCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	ws, err := LoadWorkspace()
+	if err != nil {
+		log.Errorf("Can't load workspace: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	repos, err := ws.Repositories()
+	if err != nil {
+		log.Errorf("%v", err)
+		return subcommands.ExitFailure
+	}
+	width := 0
+	for _, repo := range repos {
+		if len(repo.Name) > width {
+			width = len(repo.Name)
+		}
+	}
+
+	result := subcommands.ExitSuccess
+	for _, repo := range repos {
+		status, err := repo.GitStatus()
+		if err != nil {
+			log.Errorf("%v", err)
+			result = subcommands.ExitFailure
+			continue
+		}
+		line := fmt.Sprintf("%-*s  %s", width, repo.Name, describeStatus(status))
+		if len(repo.Packages) != 1 || repo.Packages[0] != repo.Name {
+			line += fmt.Sprintf(" (%s)", strings.Join(repo.Packages, ", "))
+		}
+		fmt.Println(line)
+	}
+	return result
+}
+
+// describeStatus summarizes a repository's checkout on one line, like
+// "master abc1234 [origin/master: ahead 1, behind 2] dirty".
+func describeStatus(status RepositoryStatus) string {
+	branch := status.Branch
+	if branch == "" {
+		branch = "(detached)"
+	}
+	commit := status.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	result := fmt.Sprintf("%s %s", branch, commit)
+
+	if status.Upstream != "" {
+		counts := make([]string, 0, 2)
+		if status.Ahead > 0 {
+			counts = append(counts, fmt.Sprintf("ahead %d", status.Ahead))
+		}
+		if status.Behind > 0 {
+			counts = append(counts, fmt.Sprintf("behind %d", status.Behind))
+		}
+		if len(counts) == 0 {
+			counts = append(counts, "up to date")
+		}
+		result += fmt.Sprintf(" [%s: %s]", status.Upstream, strings.Join(counts, ", "))
+	}
+	if status.Dirty {
+		result += " dirty"
+	}
+	return result
+}
+
+// SYNC
+type workspaceSyncCmd struct {
+	locked bool
+}
+
+func (*workspaceSyncCmd) Name() string { return "sync" }
+func (*workspaceSyncCmd) Synopsis() string {
+	return "Fetch and fast-forward every repository, or restore the commits in workspace.lock"
+}
+func (*workspaceSyncCmd) Usage() string {
+	return `sync [-locked]`
+}
+
+func (w *workspaceSyncCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&w.locked, "locked", false, "Check out the commits recorded in workspace.lock instead, cloning missing repositories")
+}
+
+func (w *workspaceSyncCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if w.locked {
+		return restoreWorkspaceLock(ctx)
+	}
+
+	ws, err := LoadWorkspace()
+	if err != nil {
+		log.Errorf("Can't load workspace: %v", err)
+		return subcommands.ExitFailure
+	}
+	repos, err := ws.Repositories()
+	if err != nil {
+		log.Errorf("%v", err)
+		return subcommands.ExitFailure
+	}
+
+	result := subcommands.ExitSuccess
+	for _, repo := range repos {
+		updated, err := repo.Sync(ctx)
+		if err != nil {
+			log.Errorf("%v", err)
+			result = subcommands.ExitFailure
+			continue
+		}
+		if updated {
+			log.Infof("Updated %s", repo.Name)
+		} else {
+			log.Infof("%s is up to date", repo.Name)
+		}
+	}
+	return result
+}
+
+// restoreWorkspaceLock checks out the commit workspace.lock records for
+// every repository, cloning the ones that aren't there. The workspace isn't
+// loaded first, since its packages may not be checked out yet.
+func restoreWorkspaceLock(ctx context.Context) subcommands.ExitStatus {
+	ws, lock, err := ReadWorkspaceLock()
+	if err != nil {
+		log.Errorf("%v", err)
+		return subcommands.ExitFailure
+	}
+
+	names := make([]string, 0, len(lock.Repositories))
+	for name := range lock.Repositories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := subcommands.ExitSuccess
+	for _, name := range names {
+		locked := lock.Repositories[name]
+		if err := ws.Repository(name).Restore(ctx, locked); err != nil {
+			log.Errorf("%v", err)
+			result = subcommands.ExitFailure
+			continue
+		}
+		log.Infof("Checked out %s at %s", name, locked.Commit)
+	}
+	if result != subcommands.ExitSuccess {
+		return result
+	}
+
+	// With everything checked out the workspace should load
+	loaded, err := LoadWorkspace()
+	if err != nil {
+		log.Warnf("Can't load workspace after restoring it: %v", err)
+		return result
+	}
+	repos, err := loaded.Repositories()
+	if err != nil {
+		log.Warnf("%v", err)
+		return result
+	}
+	for _, repo := range repos {
+		if _, ok := lock.Repositories[repo.Name]; !ok {
+			log.Warnf("%s isn't in %s, left it alone", repo.Name, LockFileName)
+		}
+	}
+	return result
+}
+
+// LOCK
+type workspaceLockCmd struct{}
+
+func (*workspaceLockCmd) Name() string { return "lock" }
+func (*workspaceLockCmd) Synopsis() string {
+	return "Record the commit of every repository in workspace.lock"
+}
+func (*workspaceLockCmd) Usage() string {
+	return `lock`
+}
+
+func (w *workspaceLockCmd) SetFlags(f *flag.FlagSet) {}
+
+func (w *workspaceLockCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	ws, err := LoadWorkspace()
+	if err != nil {
+		log.Errorf("Can't load workspace: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	repos, err := ws.Repositories()
+	if err != nil {
+		log.Errorf("%v", err)
+		return subcommands.ExitFailure
+	}
+	lock, err := ws.Lock()
+	if err != nil {
+		log.Errorf("%v", err)
+		return subcommands.ExitFailure
+	}
+	for _, repo := range repos {
+		if status, err := repo.GitStatus(); err == nil && status.Dirty {
+			log.Warnf("%s has uncommitted changes, they aren't part of the lock", repo.Name)
+		}
+	}
+	if err := ws.SaveLock(lock); err != nil {
+		log.Errorf("%v", err)
+		return subcommands.ExitFailure
+	}
+
+	log.Infof("Wrote %s", ws.LockFile())
+	return subcommands.ExitSuccess
+}
+
 // LOCATION
 type workspaceLocationCmd struct{}
 
@@ -170,96 +398,140 @@ type workspaceAddCmd struct {
 func (*workspaceAddCmd) Name() string     { return "add" }
 func (*workspaceAddCmd) Synopsis() string { return "Add a repository to this workspace" }
 func (*workspaceAddCmd) Usage() string {
-	return `add <org/repository>`
+	return `add <repository URL>`
 }
 
 func (w *workspaceAddCmd) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&w.Branch, "branch", "", "Use a specific branch when cloning (default is master)")
+	f.StringVar(&w.Branch, "branch", "", "Use a specific branch when cloning (default is the remote's default branch)")
 	f.StringVar(&w.Tag, "tag", "", "Check out a specific tag")
-	f.StringVar(&w.Commit, "commit", "", "Check out a specific commit")
+	f.StringVar(&w.Commit, "commit", "", "Check out a specific commit, found on -branch if given")
 	f.BoolVar(&w.OneBranch, "only", false, "Only clone the branch specified (only useful with -branch, -tag or -commit)")
 	f.IntVar(&w.Depth, "depth", 0, "Number of commits to fetch")
 }
 
 func (w *workspaceAddCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-
-	// TODO: SSH Repositories...
-	repository := f.Args()[0]
-	var repositoryURL = repository
-	cloneParts := strings.Split(repository, "/")
-	cloneDir := cloneParts[len(cloneParts)-1]
-
-	if strings.HasSuffix(cloneDir, ".git") {
-		offset := strings.LastIndex(cloneDir, ".git")
-		cloneDir = cloneDir[0:offset]
+	if f.NArg() == 0 {
+		log.Errorf("Needs a repository to clone")
+		return subcommands.ExitFailure
+	}
+	if w.Branch != "" && w.Tag != "" {
+		log.Errorf("Only one of -branch and -tag can be used")
+		return subcommands.ExitFailure
 	}
 
-	log.Infof("Cloning %s into %s...", repository, cloneDir)
+	repositoryURL := f.Arg(0)
+	cloneDir := cloneDirName(repositoryURL)
 
-	refName := "refs/heads/master"
+	log.Infof("Cloning %s into %s...", repositoryURL, cloneDir)
+
+	// HEAD clones the remote's default branch
+	refName := plumbing.HEAD
 
 	if w.Branch != "" {
 		log.Infof("Using branch %s", w.Branch)
-		refName = fmt.Sprintf("refs/heads/%s", w.Branch)
+		refName = plumbing.NewBranchReferenceName(w.Branch)
 	}
 
 	if w.Tag != "" {
 		log.Infof("Using tag %s", w.Tag)
-		refName = fmt.Sprintf("refs/tags/%s", w.Tag)
+		refName = plumbing.NewTagReferenceName(w.Tag)
 	}
 
-	//TODO: warn if they specified more than one, use the most specific for now
+	auth, err := GitAuth(repositoryURL)
+	if err != nil {
+		log.Errorf("%v", err)
+		return subcommands.ExitFailure
+	}
 
 	cloneOpts := git.CloneOptions{
 		URL:           repositoryURL,
+		Auth:          auth,
 		Progress:      nil,
-		ReferenceName: plumbing.ReferenceName(refName),
+		ReferenceName: refName,
 		SingleBranch:  w.OneBranch,
 		Depth:         w.Depth,
 	}
-	_, err := git.PlainClone(cloneDir, false, &cloneOpts)
-
+	repo, err := git.PlainCloneContext(ctx, cloneDir, false, &cloneOpts)
+	ReportGitAuth(auth, err)
 	if err != nil {
-		log.Errorf("Error: %v", err)
-		log.Warnln("Authentication required")
-
-		// Try again with HTTP Auth
-		// TODO only do this if the URL has github?
-		githubtoken, exists := os.LookupEnv("YOURBASE_GITHUB_TOKEN")
-
-		var auth http.BasicAuth
-		if exists {
-			log.Infof("Using GitHub token")
-			auth = http.BasicAuth{Username: "yourbase", Password: githubtoken}
+		if err == transport.ErrAuthenticationRequired || err == transport.ErrAuthorizationFailed {
+			log.Errorf("Unable to clone repository: %v", err)
+			log.Infof("Set up a git credential helper or .netrc for HTTPS remotes, or an SSH agent or key for SSH remotes")
 		} else {
+			log.Errorf("Unable to clone repository: %v", err)
+		}
+		return subcommands.ExitFailure
+	}
 
-			gituser, exists := os.LookupEnv("YOURBASE_GIT_USERNAME")
-			if !exists {
-				reader := bufio.NewReader(os.Stdin)
-				fmt.Print("Username: ")
-				gituser, _ = reader.ReadString('\n')
-			}
+	if w.Commit != "" {
+		log.Infof("Checking out commit %s", w.Commit)
+		if err := checkoutCommit(repo, w.Commit); err != nil {
+			log.Errorf("%v", err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
 
-			gitpassword, exists := os.LookupEnv("YOURBASE_GIT_PASSWORD")
-			if !exists {
-				reader := bufio.NewReader(os.Stdin)
-				fmt.Print("Password: ")
-				gitpassword, _ = reader.ReadString('\n')
-			}
+	if head, err := repo.Head(); err == nil && head.Name().IsBranch() {
+		log.Infof("Checked out branch %s", head.Name().Short())
+	}
+	return subcommands.ExitSuccess
+}
 
-			auth = http.BasicAuth{Username: gituser, Password: gitpassword}
-		}
+// cloneDirName returns the directory a repository is cloned into: the last
+// element of its URL without .git, as git does. SSH remotes like
+// git@github.com:org/repo.git are handled too.
+func cloneDirName(repositoryURL string) string {
+	name := strings.TrimRight(repositoryURL, "/")
+	if i := strings.LastIndexAny(name, "/:"); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.TrimSuffix(name, ".git")
+}
 
-		cloneOpts.Auth = &auth
+// checkoutCommit checks out commit, which may be abbreviated, in repo,
+// leaving HEAD detached.
+func checkoutCommit(repo *git.Repository, commit string) error {
+	hash, err := resolveCommit(repo, commit)
+	if err != nil {
+		return err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Hash: hash}); err != nil {
+		return fmt.Errorf("Unable to check out %s: %v", commit, err)
+	}
+	return nil
+}
 
-		_, err := git.PlainClone(cloneDir, false, &cloneOpts)
-		if err != nil {
-			log.Errorf("Unable to clone repository, even with authentication: %v", err)
-			return subcommands.ExitFailure
+// resolveCommit finds the commit in repo whose hash starts with prefix.
+func resolveCommit(repo *git.Repository, prefix string) (plumbing.Hash, error) {
+	prefix = strings.ToLower(prefix)
+	commits, err := repo.CommitObjects()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	matches := make([]plumbing.Hash, 0, 1)
+	err = commits.ForEach(func(c *object.Commit) error {
+		if strings.HasPrefix(c.Hash.String(), prefix) {
+			matches = append(matches, c.Hash)
 		}
+		return nil
+	})
+	if err != nil {
+		return plumbing.ZeroHash, err
 	}
 
-	return subcommands.ExitSuccess
+	switch len(matches) {
+	case 0:
+		return plumbing.ZeroHash, fmt.Errorf("Commit %s not found in the cloned history", prefix)
+	case 1:
+		return matches[0], nil
+	default:
+		return plumbing.ZeroHash, fmt.Errorf("Commit %s is ambiguous, it matches %d commits", prefix, len(matches))
+	}
 }
 
 // SET TARGET PACKAGE
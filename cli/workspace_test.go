@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+func TestCloneDirName(t *testing.T) {
+	tests := []struct {
+		url, dir string
+	}{
+		{url: "https://github.com/yourbase/yb.git", dir: "yb"},
+		{url: "https://github.com/yourbase/yb/", dir: "yb"},
+		{url: "git@github.com:yourbase/narwhal.git", dir: "narwhal"},
+		{url: "git@example.com:repo.git", dir: "repo"},
+		{url: "ssh://git@example.com:2222/org/repo", dir: "repo"},
+	}
+	for _, tt := range tests {
+		if got := cloneDirName(tt.url); got != tt.dir {
+			t.Errorf("cloneDirName(%q) = %q, want %q", tt.url, got, tt.dir)
+		}
+	}
+}
+
+func TestCheckoutCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(content string) string {
+		if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wt.Add("README"); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := wt.Commit(content, &git.CommitOptions{
+			Author: &object.Signature{Name: "yb", Email: "yb@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash.String()
+	}
+	first := commit("one")
+	commit("two")
+
+	if err := checkoutCommit(repo, first[:8]); err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Hash().String() != first {
+		t.Errorf("HEAD = %s, want %s", head.Hash(), first)
+	}
+
+	if err := checkoutCommit(repo, "0000000"); err == nil {
+		t.Error("checkoutCommit succeeded with an unknown commit")
+	}
+}
@@ -8,7 +8,7 @@ require (
 	github.com/dsnet/compress v0.0.1 // indirect
 	github.com/equinox-io/equinox v1.2.0
 	github.com/frankban/quicktest v1.5.0 // indirect
-	github.com/fsouza/go-dockerclient v1.6.5 // indirect
+	github.com/fsouza/go-dockerclient v1.6.5
 	github.com/gobwas/httphead v0.0.0-20180130184737-2c6c146eadee // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/gobwas/ws v1.0.3
@@ -5,7 +5,9 @@ import (
 	"flag"
 	"github.com/johnewart/subcommands"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
 
 	. "github.com/yourbase/yb/cli"
 )
@@ -22,6 +24,7 @@ func main() {
 	cmdr.Register(cmdr.FlagsCommand(), "")
 	cmdr.Register(cmdr.CommandsCommand(), "")
 	cmdr.Register(&BuildCmd{Version: version, Channel: channel}, "")
+	cmdr.Register(&CICmd{}, "")
 	cmdr.Register(&CheckConfigCmd{}, "")
 	cmdr.Register(&ConfigCmd{}, "")
 	cmdr.Register(&ExecCmd{}, "")
@@ -36,9 +39,13 @@ func main() {
 
 	flag.Parse()
 	ctx, cancel := context.WithCancel(context.Background())
+	// The first interrupt cancels the command, so it can clean up after
+	// itself, and a second one kills yb as usual
 	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		signal.Stop(c)
 		cancel()
 	}()
 	os.Exit(int(cmdr.Execute(ctx)))
@@ -10,6 +10,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	ybconfig "github.com/yourbase/yb/config"
+	"github.com/yourbase/yb/plumbing/redact"
 )
 
 var (
@@ -100,7 +101,7 @@ func (f *YbFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 		prefix = fmt.Sprintf("[%3s] ", strings.ToUpper(s))
 	}
 
-	entry.Message = fmt.Sprintf("%s%s\n", prefix, entry.Message)
+	entry.Message = redact.String(fmt.Sprintf("%s%s\n", prefix, entry.Message))
 	if !f.NoPrettyOut && checkIfTerminal(log.Out) {
 		return f.innerFormatter.Format(entry)
 	}
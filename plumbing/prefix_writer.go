@@ -0,0 +1,71 @@
+package plumbing
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// PrefixWriter prepends a prefix to every line written to it before passing
+// the line on to the underlying writer. Partial lines are held back until
+// they are terminated or the writer is flushed, so PrefixWriters that share
+// the same mutex never interleave output within a line.
+type PrefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	mu     *sync.Mutex
+	buf    []byte
+}
+
+// NewPrefixWriter returns a PrefixWriter writing to w. If mu is nil the
+// writer uses a mutex of its own.
+func NewPrefixWriter(w io.Writer, prefix string, mu *sync.Mutex) *PrefixWriter {
+	if mu == nil {
+		mu = new(sync.Mutex)
+	}
+	return &PrefixWriter{
+		w:      w,
+		prefix: []byte(prefix),
+		mu:     mu,
+	}
+}
+
+func (p *PrefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+
+	return len(b), nil
+}
+
+// Flush writes out any buffered partial line, terminating it with a newline.
+func (p *PrefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.buf) == 0 {
+		return nil
+	}
+	line := append(p.buf, '\n')
+	p.buf = nil
+	return p.writeLine(line)
+}
+
+func (p *PrefixWriter) writeLine(line []byte) error {
+	out := make([]byte, 0, len(p.prefix)+len(line))
+	out = append(out, p.prefix...)
+	out = append(out, line...)
+	_, err := p.w.Write(out)
+	return err
+}
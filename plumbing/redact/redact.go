@@ -0,0 +1,129 @@
+// Package redact keeps track of secret values and masks them in anything yb
+// prints or stores.
+package redact
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces every occurrence of a secret.
+const Mask = "***"
+
+var (
+	mu      sync.RWMutex
+	secrets []string
+)
+
+// Add registers a secret value to be masked from now on. Empty values are
+// ignored.
+func Add(secret string) {
+	if secret == "" {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+	// Longest first, so a secret containing another one is masked whole
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// Reset forgets every registered secret.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	secrets = nil
+}
+
+// String returns s with every registered secret replaced by Mask.
+func String(s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	out, _ := redact([]byte(s), true)
+	return string(out)
+}
+
+// redact masks the secrets in b. Unless final is set, it stops at the first
+// spot where b might end in the middle of a secret and returns what's left to
+// be looked at once more output has come in.
+func redact(b []byte, final bool) (out []byte, rest []byte) {
+	if len(secrets) == 0 {
+		return b, nil
+	}
+	out = make([]byte, 0, len(b))
+	for i := 0; i < len(b); {
+		remaining := b[i:]
+		match := ""
+		for _, secret := range secrets {
+			if bytes.HasPrefix(remaining, []byte(secret)) {
+				match = secret
+				break
+			}
+			// A longer secret might still turn up here
+			if !final && len(remaining) < len(secret) && strings.HasPrefix(secret, string(remaining)) {
+				return out, remaining
+			}
+		}
+		if match != "" {
+			out = append(out, Mask...)
+			i += len(match)
+		} else {
+			out = append(out, b[i])
+			i++
+		}
+	}
+	return out, nil
+}
+
+// Writer masks secrets in everything written to it before passing it on.
+// A secret can be split across writes, so output that might be the start of
+// one is held back until it's clear it isn't, or until Flush is called.
+type Writer struct {
+	w   io.Writer
+	mu  sync.Mutex
+	buf []byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	mu.RLock()
+	out, rest := redact(append(w.buf, p...), false)
+	mu.RUnlock()
+
+	w.buf = append([]byte(nil), rest...)
+	if _, err := w.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes out anything that was held back.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+	mu.RLock()
+	out, _ := redact(w.buf, true)
+	mu.RUnlock()
+	w.buf = nil
+	_, err := w.w.Write(out)
+	return err
+}
@@ -0,0 +1,41 @@
+package redact
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	defer Reset()
+	Add("hunter2")
+	Add("hunter2-admin")
+	Add("")
+
+	got := String("password=hunter2 admin=hunter2-admin")
+	if want := "password=*** admin=***"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	defer Reset()
+	Add("s3cr3t-token")
+	Add("abc")
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, chunk := range []string{"token: s3c", "r3t-to", "ken\n", "ab", "c and s3cr"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := buf.String(), "token: ***\n*** and "; got != want {
+		t.Errorf("before Flush: %q, want %q", got, want)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "token: ***\n*** and s3cr"; got != want {
+		t.Errorf("after Flush: %q, want %q", got, want)
+	}
+}
@@ -9,10 +9,13 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/yourbase/yb/plumbing/log"
 
+	docker "github.com/fsouza/go-dockerclient"
 	"github.com/yourbase/narwhal"
 )
 
@@ -27,6 +30,8 @@ type ContainerTarget struct {
 	Container   *narwhal.Container
 	Environment []string
 	workDir     string
+	// Guards Environment, processes may be run concurrently
+	envLock sync.Mutex
 }
 
 func (t *ContainerTarget) OS() Os {
@@ -115,6 +120,9 @@ func (t *ContainerTarget) CacheDir(ctx context.Context) string {
 }
 
 func (t *ContainerTarget) PrependToPath(ctx context.Context, dir string) {
+	t.envLock.Lock()
+	defer t.envLock.Unlock()
+
 	pathSet := false
 	for i, e := range t.Environment {
 		parts := strings.Split(e, "=")
@@ -129,7 +137,7 @@ func (t *ContainerTarget) PrependToPath(ctx context.Context, dir string) {
 
 	if !pathSet {
 		path := fmt.Sprintf("%s:%s", dir, t.GetDefaultPath())
-		t.SetEnv("PATH", path)
+		t.Environment = append(t.Environment, "PATH="+path)
 	}
 }
 
@@ -214,6 +222,9 @@ func (t *ContainerTarget) WorkDir() string {
 }
 
 func (t *ContainerTarget) SetEnv(key string, value string) error {
+	t.envLock.Lock()
+	defer t.envLock.Unlock()
+
 	envString := fmt.Sprintf("%s=%s", key, value)
 	if t.Environment == nil {
 		t.Environment = make([]string, 0)
@@ -225,8 +236,14 @@ func (t *ContainerTarget) SetEnv(key string, value string) error {
 func (t *ContainerTarget) Run(ctx context.Context, p Process) error {
 	log.Infof("Running container process: %s\n", p.Command)
 
-	p.Environment = append(p.Environment, t.Environment...)
-	p.Environment = append(p.Environment, t.Container.Definition.Environment...)
+	// Build the environment afresh, several processes may be starting at
+	// once and none of them should see another's variables
+	t.envLock.Lock()
+	env := make([]string, 0, len(p.Environment)+len(t.Environment)+len(t.Container.Definition.Environment))
+	env = append(env, p.Environment...)
+	env = append(env, t.Environment...)
+	t.envLock.Unlock()
+	p.Environment = append(env, t.Container.Definition.Environment...)
 
 	log.Debugf("Process env: %v", p.Environment)
 
@@ -237,8 +254,6 @@ func (t *ContainerTarget) Run(ctx context.Context, p Process) error {
 		output = p.Output
 	}
 
-	t.Container.Definition.Environment = p.Environment
-
 	if p.Interactive {
 		return narwhal.ExecShell(ctx, narwhal.DockerClient(), t.Container.Id, p.Command, &narwhal.ExecShellOptions{
 			Dir:            p.Directory,
@@ -265,6 +280,63 @@ func (t *ContainerTarget) Run(ctx context.Context, p Process) error {
 	}
 }
 
+// PortAddress returns the address the host reaches a TCP port of the
+// container at. Where Docker runs natively that is the container's address on
+// its runtime's network. Elsewhere, like on macOS and Windows, that network
+// lives in a VM, so like narwhal's port wait check the port has to be
+// published on 127.0.0.1 and is reached there.
+func (t *ContainerTarget) PortAddress(ctx context.Context, port int) (string, error) {
+	if HostOS() == Linux {
+		ip, err := narwhal.IPv4Address(ctx, narwhal.DockerClient(), t.Container.Id)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+	}
+
+	container, err := narwhal.DockerClient().InspectContainerWithContext(t.Container.Id, ctx)
+	if err != nil {
+		return "", err
+	}
+	if container.NetworkSettings != nil {
+		if addr, ok := publishedAddress(container.NetworkSettings.Ports, port); ok {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("Port %d of container %s isn't published on the host", port, t.Container.Name)
+}
+
+// publishedAddress returns the local address a TCP port of a container is
+// published on, given the container's port bindings.
+func publishedAddress(bindings map[docker.Port][]docker.PortBinding, port int) (string, bool) {
+	for _, b := range bindings[docker.Port(fmt.Sprintf("%d/tcp", port))] {
+		if b.HostPort == "" {
+			continue
+		}
+		switch b.HostIP {
+		case "", "0.0.0.0", "127.0.0.1":
+			return net.JoinHostPort("127.0.0.1", b.HostPort), true
+		}
+	}
+	return "", false
+}
+
+// RecentLogs returns up to the last n lines the container's own process
+// wrote to stdout and stderr.
+func (t *ContainerTarget) RecentLogs(ctx context.Context, n int) (string, error) {
+	var buf bytes.Buffer
+	err := narwhal.DockerClient().Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    t.Container.Id,
+		OutputStream: &buf,
+		ErrorStream:  &buf,
+		Stdout:       true,
+		Stderr:       true,
+		Tail:         fmt.Sprintf("%d", n),
+	})
+	return buf.String(), err
+}
+
 func (t *ContainerTarget) WriteFileContents(ctx context.Context, contents string, remotepath string) error {
 	if tmpfile, err := ioutil.TempFile("", "injection"); err != nil {
 		log.Infof("Couldn't make temporary file: %v", err)
@@ -368,3 +440,57 @@ func ForwardUnixSocketToTcp(unixSocket string) (string, error) {
 
 	return listenAddr, nil
 }
+
+// ContainerHome returns the home directory of the user containers from the
+// definition run as: HOME if the definition or its image sets it, or else
+// /root for root and /home/<user> for a named user. The image is pulled
+// first if pull is set; otherwise it has to be here already.
+func ContainerHome(ctx context.Context, cd narwhal.ContainerDefinition, pull bool) (string, error) {
+	if home := envValue(cd.Environment, "HOME"); home != "" {
+		return home, nil
+	}
+
+	client := narwhal.DockerClient()
+	if pull {
+		if err := narwhal.PullImageIfNotHere(ctx, client, nil, &cd, docker.AuthConfiguration{}); err != nil {
+			return "", err
+		}
+	}
+	image, err := client.InspectImage(cd.ImageNameWithTag())
+	if err != nil {
+		return "", fmt.Errorf("Unable to inspect image %s: %v", cd.ImageNameWithTag(), err)
+	}
+	if image.Config == nil {
+		return homeForUser(""), nil
+	}
+	if home := envValue(image.Config.Env, "HOME"); home != "" {
+		return home, nil
+	}
+	return homeForUser(image.Config.User), nil
+}
+
+// homeForUser guesses the home directory of the user an image's USER names,
+// which may be name[:group] or uid[:gid].
+func homeForUser(user string) string {
+	user = strings.SplitN(user, ":", 2)[0]
+	switch user {
+	case "", "root", "0":
+		return "/root"
+	}
+	if strings.Trim(user, "0123456789") == "" {
+		// Docker sets HOME to / for users without a passwd entry
+		return "/"
+	}
+	return "/home/" + user
+}
+
+// envValue returns the value of the last KEY=value entry for key in env.
+func envValue(env []string, key string) string {
+	value := ""
+	for _, entry := range env {
+		if strings.HasPrefix(entry, key+"=") {
+			value = entry[len(key)+1:]
+		}
+	}
+	return value
+}
@@ -0,0 +1,99 @@
+package runtime
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/yourbase/narwhal"
+)
+
+func TestHomeForUser(t *testing.T) {
+	tests := []struct {
+		user, home string
+	}{
+		{user: "", home: "/root"},
+		{user: "root", home: "/root"},
+		{user: "0:0", home: "/root"},
+		{user: "node", home: "/home/node"},
+		{user: "builder:staff", home: "/home/builder"},
+		{user: "1000", home: "/"},
+	}
+	for _, tt := range tests {
+		if got := homeForUser(tt.user); got != tt.home {
+			t.Errorf("homeForUser(%q) = %q, want %q", tt.user, got, tt.home)
+		}
+	}
+}
+
+func TestEnvValue(t *testing.T) {
+	env := []string{"HOME=/root", "HOMEDIR=/x", "HOME=/home/app"}
+	if got := envValue(env, "HOME"); got != "/home/app" {
+		t.Errorf("envValue(HOME) = %q, want /home/app", got)
+	}
+	if got := envValue(env, "USER"); got != "" {
+		t.Errorf("envValue(USER) = %q, want empty", got)
+	}
+}
+
+// Processes of the exec phase and log tailing run concurrently in the same
+// container target. Run with -race to catch them sharing state.
+func TestContainerTargetConcurrentRun(t *testing.T) {
+	definition := narwhal.ContainerDefinition{Environment: []string{"IMAGE_VAR=1"}}
+	target := &ContainerTarget{
+		Container: &narwhal.Container{Id: "yb-test-nonexistent", Definition: definition},
+	}
+	target.SetEnv("TARGET_VAR", "1")
+
+	// There may not be a Docker daemon to run anything, the environment
+	// handling is what matters here
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			target.Run(ctx, Process{Command: "true", Environment: []string{"PROCESS_VAR=1"}, Output: ioutil.Discard})
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			target.SetEnv("OTHER_VAR", "1")
+		}()
+	}
+	wg.Wait()
+
+	if got := target.Container.Definition.Environment; !reflect.DeepEqual(got, []string{"IMAGE_VAR=1"}) {
+		t.Errorf("container environment = %v after running processes, want it unchanged", got)
+	}
+}
+
+func TestPublishedAddress(t *testing.T) {
+	bindings := map[docker.Port][]docker.PortBinding{
+		"5432/tcp": {{HostIP: "127.0.0.1", HostPort: "49153"}},
+		"6379/tcp": {{HostIP: "0.0.0.0", HostPort: "6379"}},
+		"8080/tcp": {{HostIP: "192.168.1.10", HostPort: "8080"}},
+		"53/udp":   {{HostIP: "127.0.0.1", HostPort: "5353"}},
+	}
+	tests := []struct {
+		port int
+		addr string
+		ok   bool
+	}{
+		{port: 5432, addr: "127.0.0.1:49153", ok: true},
+		{port: 6379, addr: "127.0.0.1:6379", ok: true},
+		{port: 8080},
+		{port: 53},
+	}
+	for _, tt := range tests {
+		addr, ok := publishedAddress(bindings, tt.port)
+		if addr != tt.addr || ok != tt.ok {
+			t.Errorf("publishedAddress(%d) = %q, %t; want %q, %t", tt.port, addr, ok, tt.addr, tt.ok)
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/matishsiao/goInfo"
 	"github.com/yourbase/yb/plumbing"
 	"github.com/yourbase/yb/plumbing/log"
+	"github.com/yourbase/yb/plumbing/redact"
 )
 
 type MetalTarget struct {
@@ -170,8 +171,26 @@ func (t *MetalTarget) WorkDir() string {
 	return t.workDir
 }
 
+// Run runs the process on the host. Its environment is added to that of the
+// yb process, overriding variables set in both.
 func (t *MetalTarget) Run(ctx context.Context, p Process) error {
-	return t.ExecToStdout(ctx, p.Command, p.Directory)
+	output := p.Output
+	if output == nil {
+		output = os.Stdout
+	}
+	env := append(os.Environ(), p.Environment...)
+
+	// Never fall back to running unsandboxed, that's what sandboxing guards
+	// against
+	if p.Sandbox != nil {
+		err := ExecInSandbox(ctx, *p.Sandbox, p.Command, p.Directory, env, output)
+		if err == ErrSandboxUnsupported {
+			return fmt.Errorf("Unable to run '%s': %v, turn off sandbox for the target to run it anyway", p.Command, err)
+		}
+		return err
+	}
+
+	return t.execToWriterWithEnv(ctx, p.Command, p.Directory, env, output)
 }
 
 func (t *MetalTarget) SetEnv(key string, value string) error {
@@ -187,6 +206,16 @@ func (t *MetalTarget) ExecToStdoutWithExtraEnv(ctx context.Context, cmdString st
 }
 
 func (t *MetalTarget) ExecToStdoutWithEnv(ctx context.Context, cmdString string, targetDir string, env []string) error {
+	return t.execToWriterWithEnv(ctx, cmdString, targetDir, env, os.Stdout)
+}
+
+// ExecToWriter runs a command like ExecToStdout, sending its combined output
+// to w instead.
+func (t *MetalTarget) ExecToWriter(ctx context.Context, cmdString string, targetDir string, w io.Writer) error {
+	return t.execToWriterWithEnv(ctx, cmdString, targetDir, os.Environ(), w)
+}
+
+func (t *MetalTarget) execToWriterWithEnv(ctx context.Context, cmdString string, targetDir string, env []string, w io.Writer) error {
 	log.Infof("Running: %s in %s", cmdString, targetDir)
 	cmdArgs, err := shlex.Split(cmdString)
 	if err != nil {
@@ -195,9 +224,9 @@ func (t *MetalTarget) ExecToStdoutWithEnv(ctx context.Context, cmdString string,
 
 	cmd := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:len(cmdArgs)]...)
 	cmd.Dir = targetDir
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = w
 	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stdout
+	cmd.Stderr = w
 	cmd.Env = env
 
 	log.Debugf("Process env: %v", env)
@@ -228,14 +257,16 @@ func (t *MetalTarget) ExecToLog(ctx context.Context, cmdString string, targetDir
 	}
 
 	defer logfile.Close()
+	output := redact.NewWriter(logfile)
 
 	cmd := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:len(cmdArgs)]...)
 	cmd.Dir = targetDir
-	cmd.Stdout = logfile
+	cmd.Stdout = output
 	cmd.Stdin = os.Stdin
-	cmd.Stderr = logfile
+	cmd.Stderr = output
 
 	err = cmd.Run()
+	output.Flush()
 
 	if err != nil {
 		return fmt.Errorf("Command '%s' failed to run with error -- see log for information: %s", cmdString, logPath)
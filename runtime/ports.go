@@ -0,0 +1,405 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/google/shlex"
+	"github.com/yourbase/narwhal"
+
+	"github.com/yourbase/yb/plumbing/log"
+)
+
+// Image narwhal gives containers that don't name one
+const defaultContainerImage = "yourbase/yb_ubuntu:18.04"
+
+// PortMapping publishes a port, or a range of ports, of a container on the
+// host. In text it is written as
+//
+//	[bind_address:][host_port[-end]:]container_port[-end][/tcp|/udp]
+//
+// An empty HostPort lets Docker pick the ports on the host.
+type PortMapping struct {
+	HostIP        string
+	HostPort      PortRange
+	ContainerPort PortRange
+	Protocol      string
+}
+
+// PortRange is a range of ports, from Start to End inclusive. A single port
+// has End equal to Start, and the zero value means no port at all.
+type PortRange struct {
+	Start int
+	End   int
+}
+
+func (r PortRange) IsZero() bool {
+	return r.Start == 0
+}
+
+func (r PortRange) Len() int {
+	return r.End - r.Start + 1
+}
+
+func (r PortRange) String() string {
+	if r.IsZero() {
+		return ""
+	}
+	if r.End == r.Start {
+		return strconv.Itoa(r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+var portRangeRe = regexp.MustCompile(`^(\d+)(?:-(\d+))?$`)
+
+func parsePortRange(s string) (PortRange, error) {
+	m := portRangeRe.FindStringSubmatch(s)
+	if m == nil {
+		return PortRange{}, fmt.Errorf("'%s' is not a port or a range of ports", s)
+	}
+	start, _ := strconv.Atoi(m[1])
+	end := start
+	if m[2] != "" {
+		end, _ = strconv.Atoi(m[2])
+	}
+	if start < 1 || end > 65535 || end < start {
+		return PortRange{}, fmt.Errorf("'%s' is not a valid range of ports", s)
+	}
+	return PortRange{Start: start, End: end}, nil
+}
+
+// ParsePortMapping parses a port mapping like "53/udp", "8080:80" or
+// "127.0.0.1:9000-9010:9000-9010/tcp".
+func ParsePortMapping(spec string) (PortMapping, error) {
+	m := PortMapping{Protocol: "tcp"}
+
+	rest := spec
+	if i := strings.LastIndex(rest, "/"); i >= 0 {
+		m.Protocol = strings.ToLower(rest[i+1:])
+		rest = rest[:i]
+		if m.Protocol != "tcp" && m.Protocol != "udp" {
+			return PortMapping{}, fmt.Errorf("Port mapping '%s': unknown protocol '%s'", spec, m.Protocol)
+		}
+	}
+
+	parts := strings.Split(rest, ":")
+	var hostPort string
+	switch len(parts) {
+	case 1:
+	case 2:
+		hostPort = parts[0]
+	case 3:
+		m.HostIP = parts[0]
+		hostPort = parts[1]
+		if m.HostIP == "" {
+			return PortMapping{}, fmt.Errorf("Port mapping '%s': empty bind address", spec)
+		}
+	default:
+		return PortMapping{}, fmt.Errorf("Port mapping '%s' has too many parts", spec)
+	}
+
+	var err error
+	m.ContainerPort, err = parsePortRange(parts[len(parts)-1])
+	if err != nil {
+		return PortMapping{}, fmt.Errorf("Port mapping '%s': %v", spec, err)
+	}
+	if hostPort != "" {
+		m.HostPort, err = parsePortRange(hostPort)
+		if err != nil {
+			return PortMapping{}, fmt.Errorf("Port mapping '%s': %v", spec, err)
+		}
+		if m.HostPort.Len() != m.ContainerPort.Len() {
+			return PortMapping{}, fmt.Errorf("Port mapping '%s': host and container ranges differ in size", spec)
+		}
+	}
+
+	return m, nil
+}
+
+// String returns the mapping in the syntax ParsePortMapping reads. The
+// protocol is left out for TCP.
+func (m PortMapping) String() string {
+	s := m.ContainerPort.String()
+	if !m.HostPort.IsZero() || m.HostIP != "" {
+		s = m.HostPort.String() + ":" + s
+	}
+	if m.HostIP != "" {
+		s = m.HostIP + ":" + s
+	}
+	if m.Protocol != "tcp" {
+		s += "/" + m.Protocol
+	}
+	return s
+}
+
+// narwhalCompatible reports whether narwhal can publish the mapping itself:
+// a single TCP port on a given host port, bound to every address.
+func (m PortMapping) narwhalCompatible() bool {
+	return m.HostIP == "" && m.Protocol == "tcp" && !m.HostPort.IsZero() && m.ContainerPort.Len() == 1
+}
+
+// addBindings adds the ports of the mapping to the bindings and exposed ports
+// of a container.
+func (m PortMapping) addBindings(bindings map[docker.Port][]docker.PortBinding, exposed map[docker.Port]struct{}) {
+	hostIP := m.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	for i := 0; i < m.ContainerPort.Len(); i++ {
+		port := docker.Port(fmt.Sprintf("%d/%s", m.ContainerPort.Start+i, m.Protocol))
+		hostPort := ""
+		if !m.HostPort.IsZero() {
+			hostPort = strconv.Itoa(m.HostPort.Start + i)
+		}
+		bindings[port] = append(bindings[port], docker.PortBinding{HostIP: hostIP, HostPort: hostPort})
+		exposed[port] = struct{}{}
+	}
+}
+
+// Docker labels marking the containers a runtime creates itself, with the
+// runtime's identifier and the container's label as values
+const (
+	runtimeLabel   = "io.yourbase.yb.runtime"
+	containerLabel = "io.yourbase.yb.container"
+)
+
+// startContainerWithPorts starts the container of cd with the Docker API, for
+// the port mappings narwhal can't publish. Like narwhal's containers it is
+// attached to the runtime's network, and if cd has a port wait check, the
+// port is waited for. A container an earlier run created for cd is reused
+// if it publishes the same ports, and created again otherwise.
+func (r *Runtime) startContainerWithPorts(ctx context.Context, cd narwhal.ContainerDefinition, mappings []PortMapping) (_ *narwhal.Container, err error) {
+	client := r.ContainerServiceContext.DockerClient
+	bindings, exposed := containerPorts(cd, mappings)
+
+	container, err := r.findLabelledContainer(ctx, cd)
+	if err != nil {
+		return nil, err
+	}
+	if container != nil {
+		existing, err := client.InspectContainerWithContext(container.Id, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to inspect container %s: %v", container.Name, err)
+		}
+		if existing.HostConfig == nil || !samePortBindings(existing.HostConfig.PortBindings, bindings) {
+			log.Infof("Ports of container %s changed, creating it again", container.Name)
+			if err := removeContainer(ctx, client, container.Id); err != nil {
+				return nil, fmt.Errorf("Unable to remove container %s: %v", container.Name, err)
+			}
+			container = nil
+		}
+	}
+	if container == nil {
+		for _, m := range mappings {
+			log.Infof("Publishing %s of container %s", m, cd.Label)
+		}
+		container, err = r.createContainerWithPorts(ctx, cd, bindings, exposed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		if err != nil {
+			if rmErr := removeContainer(context.Background(), client, container.Id); rmErr != nil {
+				log.Warnf("Leaked container %s: %v", container.Name, rmErr)
+			}
+		}
+	}()
+
+	if err := narwhal.StartContainer(ctx, client, container.Id); err != nil {
+		return nil, fmt.Errorf("Unable to start container %s: %v", container.Name, err)
+	}
+	if cd.PortWaitCheck.Port != 0 {
+		if err := waitForPort(ctx, &ContainerTarget{Container: container}, cd.PortWaitCheck); err != nil {
+			return nil, err
+		}
+	}
+	return container, nil
+}
+
+// containerPorts returns the port bindings and exposed ports of the container
+// of cd, publishing mappings.
+func containerPorts(cd narwhal.ContainerDefinition, mappings []PortMapping) (map[docker.Port][]docker.PortBinding, map[docker.Port]struct{}) {
+	bindings := make(map[docker.Port][]docker.PortBinding)
+	exposed := make(map[docker.Port]struct{})
+	for _, m := range mappings {
+		m.addBindings(bindings, exposed)
+	}
+	if port := cd.PortWaitCheck.Port; port != 0 && HostOS() != Linux {
+		// The port waited for is only reachable through a local port when
+		// Docker doesn't run natively, so publish it like narwhal does
+		local := PortMapping{HostIP: "127.0.0.1", ContainerPort: PortRange{Start: port, End: port}, Protocol: "tcp"}
+		local.addBindings(bindings, exposed)
+	}
+	return bindings, exposed
+}
+
+// samePortBindings reports whether two containers publish the same ports.
+func samePortBindings(a map[docker.Port][]docker.PortBinding, b map[docker.Port][]docker.PortBinding) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for port, bindings := range a {
+		other, ok := b[port]
+		if !ok || len(bindings) != len(other) {
+			return false
+		}
+		for i := range bindings {
+			if bindings[i] != other[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// containerName returns the name of the container of cd, the runtime's
+// identifier and the container's label, the way narwhal namespaces the
+// containers it creates.
+func containerName(namespace string, cd narwhal.ContainerDefinition) string {
+	name := unsafeNameChars.ReplaceAllString(namespace+"-"+cd.Label, "_")
+	return strings.TrimLeft(name, "_.-")
+}
+
+// Characters Docker doesn't allow in container names
+var unsafeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// createContainerWithPorts creates the container of cd, labelled as the
+// runtime's, with the given ports published on the host.
+func (r *Runtime) createContainerWithPorts(ctx context.Context, cd narwhal.ContainerDefinition, bindings map[docker.Port][]docker.PortBinding, exposed map[docker.Port]struct{}) (*narwhal.Container, error) {
+	sc := r.ContainerServiceContext
+	client := sc.DockerClient
+
+	if cd.Image == "" {
+		cd.Image = defaultContainerImage
+	}
+	if err := narwhal.PullImageIfNotHere(ctx, client, nil, &cd, docker.AuthConfiguration{}); err != nil {
+		return nil, err
+	}
+
+	mounts, err := cd.DockerMounts()
+	if err != nil {
+		return nil, fmt.Errorf("Container %s mounts: %v", cd.Label, err)
+	}
+
+	config := &docker.Config{
+		Env:          cd.Environment,
+		Image:        cd.ImageNameWithTag(),
+		WorkingDir:   cd.WorkDir,
+		ExposedPorts: exposed,
+		Labels: map[string]string{
+			runtimeLabel:   sc.Id,
+			containerLabel: cd.Label,
+		},
+	}
+	if cd.Command != "" {
+		config.Cmd, err = shlex.Split(cd.Command)
+		if err != nil {
+			return nil, fmt.Errorf("Command of container %s: %v", cd.Label, err)
+		}
+	}
+
+	name := containerName(sc.Id, cd)
+	created, err := client.CreateContainer(docker.CreateContainerOptions{
+		Context: ctx,
+		Name:    name,
+		Config:  config,
+		HostConfig: &docker.HostConfig{
+			Mounts:       mounts,
+			PortBindings: bindings,
+			Privileged:   cd.Privileged,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create container %s: %v", name, err)
+	}
+	container := &narwhal.Container{Id: created.ID, Name: name, Definition: cd}
+
+	err = client.ConnectNetwork(sc.NetworkId, docker.NetworkConnectionOptions{
+		Context:        ctx,
+		Container:      created.ID,
+		EndpointConfig: &docker.EndpointConfig{NetworkID: sc.NetworkId},
+	})
+	if err != nil {
+		if rmErr := removeContainer(context.Background(), client, created.ID); rmErr != nil {
+			log.Warnf("Leaked container %s: %v", name, rmErr)
+		}
+		return nil, fmt.Errorf("Unable to connect container %s to network: %v", name, err)
+	}
+
+	return container, nil
+}
+
+// removeContainer removes a container along with its volumes, whether it is
+// running or not.
+func removeContainer(ctx context.Context, client *docker.Client, id string) error {
+	return client.RemoveContainer(docker.RemoveContainerOptions{
+		Context:       ctx,
+		ID:            id,
+		RemoveVolumes: true,
+		Force:         true,
+	})
+}
+
+// findLabelledContainer returns the container the runtime created itself for
+// cd, or nil if there is none.
+func (r *Runtime) findLabelledContainer(ctx context.Context, cd narwhal.ContainerDefinition) (*narwhal.Container, error) {
+	containers, err := r.ContainerServiceContext.DockerClient.ListContainers(docker.ListContainersOptions{
+		Context: ctx,
+		All:     true,
+		Filters: map[string][]string{
+			"label": {
+				runtimeLabel + "=" + r.ContainerServiceContext.Id,
+				containerLabel + "=" + cd.Label,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to look for container %s: %v", cd.Label, err)
+	}
+	if len(containers) == 0 {
+		return nil, nil
+	}
+
+	c := containers[0]
+	name := cd.Label
+	if len(c.Names) > 0 {
+		name = strings.TrimPrefix(c.Names[0], "/")
+	}
+	return &narwhal.Container{Id: c.ID, Name: name, Definition: cd}, nil
+}
+
+// waitForPort waits until the port of a port wait check accepts connections,
+// as narwhal does for the containers it starts.
+func waitForPort(ctx context.Context, t *ContainerTarget, check narwhal.PortWaitCheck) error {
+	timeout := time.Duration(check.Timeout) * time.Second
+	log.Infof("Waiting up to %s for %s to be ready", timeout, t.Container.Definition.Label)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var dialer net.Dialer
+	for {
+		addr, err := t.PortAddress(ctx, check.Port)
+		if err == nil {
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, "tcp", addr); err == nil {
+				return conn.Close()
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("Port %d of container %s isn't ready: %v", check.Port, t.Container.Name, err)
+		}
+	}
+}
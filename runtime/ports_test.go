@@ -0,0 +1,141 @@
+package runtime
+
+import (
+	"reflect"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/yourbase/narwhal"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		spec   string
+		want   PortMapping
+		string string
+	}{
+		{
+			spec:   "8080",
+			want:   PortMapping{ContainerPort: PortRange{8080, 8080}, Protocol: "tcp"},
+			string: "8080",
+		},
+		{
+			spec:   "53/udp",
+			want:   PortMapping{ContainerPort: PortRange{53, 53}, Protocol: "udp"},
+			string: "53/udp",
+		},
+		{
+			spec:   "8080:80/tcp",
+			want:   PortMapping{HostPort: PortRange{8080, 8080}, ContainerPort: PortRange{80, 80}, Protocol: "tcp"},
+			string: "8080:80",
+		},
+		{
+			spec:   "127.0.0.1:9000-9002:8000-8002/UDP",
+			want:   PortMapping{HostIP: "127.0.0.1", HostPort: PortRange{9000, 9002}, ContainerPort: PortRange{8000, 8002}, Protocol: "udp"},
+			string: "127.0.0.1:9000-9002:8000-8002/udp",
+		},
+		{
+			spec:   "127.0.0.1::8125/udp",
+			want:   PortMapping{HostIP: "127.0.0.1", ContainerPort: PortRange{8125, 8125}, Protocol: "udp"},
+			string: "127.0.0.1::8125/udp",
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortMapping(tt.spec)
+		if err != nil {
+			t.Errorf("ParsePortMapping(%q): %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParsePortMapping(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+		if s := got.String(); s != tt.string {
+			t.Errorf("ParsePortMapping(%q).String() = %q, want %q", tt.spec, s, tt.string)
+		}
+	}
+}
+
+func TestParsePortMappingErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"http",
+		"80/sctp",
+		"0",
+		"70000",
+		"90-80",
+		"9000-9002:80",
+		":8080:80",
+		"a:b:80:80",
+	} {
+		if m, err := ParsePortMapping(spec); err == nil {
+			t.Errorf("ParsePortMapping(%q) = %+v, want an error", spec, m)
+		}
+	}
+}
+
+func TestPortMappingBindings(t *testing.T) {
+	m, err := ParsePortMapping("5000-5001:6000-6001/udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.narwhalCompatible() {
+		t.Error("narwhal can't publish UDP ranges")
+	}
+
+	bindings := make(map[docker.Port][]docker.PortBinding)
+	exposed := make(map[docker.Port]struct{})
+	m.addBindings(bindings, exposed)
+
+	want := map[docker.Port][]docker.PortBinding{
+		"6000/udp": {{HostIP: "0.0.0.0", HostPort: "5000"}},
+		"6001/udp": {{HostIP: "0.0.0.0", HostPort: "5001"}},
+	}
+	if !reflect.DeepEqual(bindings, want) {
+		t.Errorf("bindings = %v, want %v", bindings, want)
+	}
+	if len(exposed) != 2 {
+		t.Errorf("exposed = %v, want both ports", exposed)
+	}
+
+	if plain, _ := ParsePortMapping("8080:80"); !plain.narwhalCompatible() {
+		t.Error("narwhal should publish plain TCP ports itself")
+	}
+}
+
+func TestSamePortBindings(t *testing.T) {
+	dns, _ := ParsePortMapping("53:53/udp")
+	statsd, _ := ParsePortMapping("127.0.0.1:8125:8125/udp")
+	cd := narwhal.ContainerDefinition{Label: "dns"}
+
+	bindings, _ := containerPorts(cd, []PortMapping{dns, statsd})
+	same, _ := containerPorts(cd, []PortMapping{statsd, dns})
+	if !samePortBindings(bindings, same) {
+		t.Error("the same mappings in another order publish other ports")
+	}
+
+	moved, _ := ParsePortMapping("5353:53/udp")
+	other, _ := containerPorts(cd, []PortMapping{moved, statsd})
+	if samePortBindings(bindings, other) {
+		t.Error("changing a host port doesn't change the bindings")
+	}
+	fewer, _ := containerPorts(cd, []PortMapping{dns})
+	if samePortBindings(bindings, fewer) {
+		t.Error("dropping a mapping doesn't change the bindings")
+	}
+}
+
+func TestContainerName(t *testing.T) {
+	tests := []struct {
+		namespace, label, want string
+	}{
+		{namespace: "api-exec", label: "dns", want: "api-exec-dns"},
+		{namespace: "api-build-test_go_1.14_", label: "stats d", want: "api-build-test_go_1.14_-stats_d"},
+		{namespace: ".ws-exec", label: "db", want: "ws-exec-db"},
+	}
+	for _, tt := range tests {
+		cd := narwhal.ContainerDefinition{Label: tt.label}
+		if got := containerName(tt.namespace, cd); got != tt.want {
+			t.Errorf("containerName(%q, %q) = %q, want %q", tt.namespace, tt.label, got, tt.want)
+		}
+	}
+}
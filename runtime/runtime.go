@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 
 	"github.com/yourbase/yb/plumbing/log"
 
 	goruntime "runtime"
 
+	docker "github.com/fsouza/go-dockerclient"
 	"github.com/yourbase/narwhal"
 )
 
@@ -63,6 +65,9 @@ type Process struct {
 	Directory   string
 	Environment []string
 	Output      io.Writer
+	// Sandbox, if set, restricts what the process can access. Only host
+	// targets honor it, containers are isolated to begin with.
+	Sandbox *SandboxParameters
 }
 
 type Runtime struct {
@@ -71,6 +76,12 @@ type Runtime struct {
 	Targets                 map[string]Target
 	ContainerServiceContext *narwhal.ServiceContext
 	DefaultTarget           Target
+
+	// Containers started by AddContainer, in the order they were started
+	containers []*narwhal.Container
+	// Guards Targets, containers and the service context, which containers
+	// may be added to concurrently
+	mu sync.Mutex
 }
 
 func (r *Runtime) SupportsContainers() bool {
@@ -82,6 +93,12 @@ func (r *Runtime) NTargets() int {
 }
 
 func (r *Runtime) AddTarget(targetId string, t Target) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addTarget(targetId, t)
+}
+
+func (r *Runtime) addTarget(targetId string, t Target) error {
 	if _, exists := r.Targets[targetId]; exists {
 		return fmt.Errorf("Unable to add target with id %s - already exists", targetId)
 	}
@@ -108,7 +125,10 @@ func (r *Runtime) FindContainers(ctx context.Context, definitions []narwhal.Cont
 
 	if r.SupportsContainers() {
 		for _, cd := range definitions {
-			container, err := r.ContainerServiceContext.FindContainer(ctx, &cd)
+			container, err := r.findContainer(ctx, cd)
+			if err == nil && container == nil {
+				err = fmt.Errorf("no container for %s is running", cd.Label)
+			}
 			if err != nil {
 				log.Warnf("Error trying to find container %s - %v", cd.Label, err)
 			} else {
@@ -122,9 +142,120 @@ func (r *Runtime) FindContainers(ctx context.Context, definitions []narwhal.Cont
 	return result
 }
 
+// findContainer returns the container an earlier run started for cd, or nil
+// if there is none.
+func (r *Runtime) findContainer(ctx context.Context, cd narwhal.ContainerDefinition) (*narwhal.Container, error) {
+	container, err := r.ContainerServiceContext.FindContainer(ctx, &cd)
+	if narwhal.IsContainerNotFound(err) {
+		// Containers with ports narwhal can't publish are the runtime's own
+		return r.findLabelledContainer(ctx, cd)
+	}
+	return container, err
+}
+
+// removeChangedContainer removes the container an earlier run started for
+// cd if its mounts aren't the ones cd asks for. Docker can't change the
+// mounts of a container and narwhal reuses containers as they are, so the
+// container has to be created again for changes to take effect.
+func (r *Runtime) removeChangedContainer(ctx context.Context, cd narwhal.ContainerDefinition) error {
+	existing, err := r.findContainer(ctx, cd)
+	if err != nil || existing == nil {
+		return err
+	}
+
+	client := r.ContainerServiceContext.DockerClient
+	container, err := client.InspectContainerWithContext(existing.Id, ctx)
+	if err != nil {
+		return fmt.Errorf("Unable to inspect container %s: %v", existing.Name, err)
+	}
+	mounts, err := cd.DockerMounts()
+	if err != nil {
+		return fmt.Errorf("Container %s mounts: %v", cd.Label, err)
+	}
+	var have []docker.HostMount
+	if container.HostConfig != nil {
+		have = container.HostConfig.Mounts
+	}
+	if sameMounts(have, mounts) {
+		return nil
+	}
+
+	log.Infof("Mounts of container %s changed, creating it again", existing.Name)
+	if err := removeContainer(ctx, client, existing.Id); err != nil {
+		return fmt.Errorf("Unable to remove container %s: %v", existing.Name, err)
+	}
+	return nil
+}
+
+// sameMounts reports whether two lists of mounts bind the same host paths to
+// the same container paths, in any order.
+func sameMounts(a []docker.HostMount, b []docker.HostMount) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, m := range a {
+		count[m.Source+":"+m.Target]++
+	}
+	for _, m := range b {
+		key := m.Source + ":" + m.Target
+		if count[key] == 0 {
+			return false
+		}
+		count[key]--
+	}
+	return true
+}
+
+// PullImage pulls the image of the container definition, unless it is
+// already there. Unlike starting containers, images can be pulled in
+// parallel.
+func (r *Runtime) PullImage(ctx context.Context, cd narwhal.ContainerDefinition) error {
+	if !r.SupportsContainers() || cd.Image == "" {
+		return nil
+	}
+	return narwhal.PullImageIfNotHere(ctx, narwhal.DockerClient(), nil, &cd, docker.AuthConfiguration{})
+}
+
+// AddContainer starts a container from the definition and adds it to the
+// runtime as a target. It is safe to call concurrently: containers are
+// created, started and waited for in parallel, only recording them in the
+// runtime is serialized.
 func (r *Runtime) AddContainer(ctx context.Context, cd narwhal.ContainerDefinition) (*ContainerTarget, error) {
 	if r.SupportsContainers() {
-		container, err := r.ContainerServiceContext.StartContainer(ctx, nil, &cd)
+		mappings := make([]PortMapping, 0, len(cd.Ports))
+		compatible := true
+		for _, spec := range cd.Ports {
+			m, err := ParsePortMapping(spec)
+			if err != nil {
+				return nil, fmt.Errorf("could not start container %s: %v", cd.Label, err)
+			}
+			mappings = append(mappings, m)
+			compatible = compatible && m.narwhalCompatible()
+		}
+
+		r.mu.Lock()
+		_, exists := r.Targets[cd.Label]
+		sc := *r.ContainerServiceContext
+		r.mu.Unlock()
+		if exists {
+			return nil, fmt.Errorf("Unable to add target with id %s - already exists", cd.Label)
+		}
+		if err := r.removeChangedContainer(ctx, cd); err != nil {
+			return nil, fmt.Errorf("could not start container %s: %v", cd.Label, err)
+		}
+
+		var container *narwhal.Container
+		var err error
+		if compatible {
+			// narwhal records the definitions of the containers it starts in
+			// its service context, which isn't safe to share between
+			// goroutines, so start the container with a copy of it
+			sc.ContainerDefinitions = nil
+			container, err = sc.StartContainer(ctx, nil, &cd)
+		} else {
+			container, err = r.startContainerWithPorts(ctx, cd, mappings)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("could not start container %s: %v", cd.Label, err)
 		}
@@ -133,7 +264,11 @@ func (r *Runtime) AddContainer(ctx context.Context, cd narwhal.ContainerDefiniti
 			Container: container,
 		}
 
-		if err = r.AddTarget(cd.Label, tgt); err != nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.containers = append(r.containers, container)
+		r.ContainerServiceContext.ContainerDefinitions = append(r.ContainerServiceContext.ContainerDefinitions, cd)
+		if err = r.addTarget(cd.Label, tgt); err != nil {
 			return nil, err
 		}
 
@@ -160,9 +295,31 @@ func NewRuntime(ctx context.Context, identifier string, localWorkDir string) *Ru
 	}
 }
 
+// IdleCommand keeps a container running without doing anything, for
+// containers that only have commands run in them.
+const IdleCommand = "/usr/bin/tail -f /dev/null"
+
+// Seconds a container gets to stop on shutdown before it is killed
+const containerStopTimeout = 10
+
+// containerRemover is the part of the Docker client removeContainers uses.
+type containerRemover interface {
+	StopContainerWithContext(id string, timeout uint, ctx context.Context) error
+	RemoveContainer(opts docker.RemoveContainerOptions) error
+}
+
+// Shutdown stops and removes the runtime's containers, in the reverse of the
+// order they were started in, so no container goes away before the ones that
+// depend on it.
 func (r *Runtime) Shutdown(ctx context.Context) error {
 
 	if r.ContainerServiceContext != nil {
+		r.removeContainers(ctx, r.ContainerServiceContext.DockerClient)
+
+		// The containers are gone, leaving only the network to tear down
+		r.mu.Lock()
+		r.ContainerServiceContext.ContainerDefinitions = nil
+		r.mu.Unlock()
 		if err := r.ContainerServiceContext.TearDown(ctx); err != nil {
 			return err
 		}
@@ -171,6 +328,39 @@ func (r *Runtime) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// removeContainers stops and removes the containers the runtime started, last
+// one first.
+func (r *Runtime) removeContainers(ctx context.Context, client containerRemover) {
+	r.mu.Lock()
+	containers := r.containers
+	r.containers = nil
+	r.mu.Unlock()
+
+	for i := len(containers) - 1; i >= 0; i-- {
+		c := containers[i]
+		// The idle command ignores SIGTERM, there is nothing to wait for
+		var timeout uint = containerStopTimeout
+		if c.Definition.Command == IdleCommand {
+			timeout = 0
+		}
+		log.Infof("Stopping container %s", c.Name)
+		if err := client.StopContainerWithContext(c.Id, timeout, ctx); err != nil {
+			if _, notRunning := err.(*docker.ContainerNotRunning); !notRunning {
+				log.Warnf("Unable to stop container %s: %v", c.Name, err)
+			}
+		}
+		err := client.RemoveContainer(docker.RemoveContainerOptions{
+			Context:       ctx,
+			ID:            c.Id,
+			RemoveVolumes: true,
+			Force:         true,
+		})
+		if err != nil {
+			log.Warnf("Unable to remove container %s: %v", c.Name, err)
+		}
+	}
+}
+
 func (r *Runtime) EnvironmentData() RuntimeEnvironmentData {
 	return RuntimeEnvironmentData{
 		Containers: ContainerData{
@@ -0,0 +1,78 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/yourbase/narwhal"
+)
+
+func TestSameMounts(t *testing.T) {
+	cache := docker.HostMount{Source: "/ws/build/cache/root/.m2", Target: "/root/.m2", Type: "bind"}
+	src := docker.HostMount{Source: "/ws/api", Target: "/workspace", Type: "bind"}
+	tests := []struct {
+		a, b []docker.HostMount
+		want bool
+	}{
+		{a: nil, b: []docker.HostMount{}, want: true},
+		{a: []docker.HostMount{src, cache}, b: []docker.HostMount{cache, src}, want: true},
+		{a: []docker.HostMount{src}, b: []docker.HostMount{src, cache}, want: false},
+		{a: []docker.HostMount{src, src}, b: []docker.HostMount{src, cache}, want: false},
+		{a: []docker.HostMount{src}, b: []docker.HostMount{{Source: "/ws/web", Target: "/workspace"}}, want: false},
+	}
+	for _, tt := range tests {
+		if got := sameMounts(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameMounts(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// fakeRemover records what removeContainers does to containers.
+type fakeRemover struct {
+	calls []string
+	// IDs of containers that fail to stop
+	stuck map[string]bool
+}
+
+func (f *fakeRemover) StopContainerWithContext(id string, timeout uint, ctx context.Context) error {
+	f.calls = append(f.calls, fmt.Sprintf("stop %s %d", id, timeout))
+	if f.stuck[id] {
+		return errors.New("stuck")
+	}
+	return nil
+}
+
+func (f *fakeRemover) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	f.calls = append(f.calls, "remove "+opts.ID)
+	return nil
+}
+
+func TestRemoveContainers(t *testing.T) {
+	r := &Runtime{containers: []*narwhal.Container{
+		{Id: "db", Name: "db"},
+		{Id: "cache", Name: "cache"},
+		{Id: "build", Name: "build", Definition: narwhal.ContainerDefinition{Command: IdleCommand}},
+	}}
+	client := &fakeRemover{stuck: map[string]bool{"cache": true}}
+
+	r.removeContainers(context.Background(), client)
+	want := []string{
+		"stop build 0", "remove build",
+		// Containers that don't stop are still removed
+		"stop cache 10", "remove cache",
+		"stop db 10", "remove db",
+	}
+	if !reflect.DeepEqual(client.calls, want) {
+		t.Errorf("removeContainers() did %q, want %q", client.calls, want)
+	}
+
+	client.calls = nil
+	r.removeContainers(context.Background(), client)
+	if len(client.calls) != 0 {
+		t.Errorf("Second removeContainers() did %q, want nothing", client.calls)
+	}
+}
@@ -0,0 +1,28 @@
+package runtime
+
+import (
+	"errors"
+)
+
+// ErrSandboxUnsupported is returned by ExecInSandbox on platforms that have
+// no sandbox implementation.
+var ErrSandboxUnsupported = errors.New("sandboxed execution is not supported on this platform")
+
+// SandboxParameters describe what a sandboxed process is allowed to touch.
+// Everything outside of the workspace, tools and cache dirs is read-only.
+type SandboxParameters struct {
+	WorkspacePath string
+	ToolsDir      string
+	CacheDir      string
+	AllowNetwork  bool
+}
+
+func (s SandboxParameters) writableDirs() []string {
+	dirs := make([]string, 0, 3)
+	for _, dir := range []string{s.WorkspacePath, s.ToolsDir, s.CacheDir} {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
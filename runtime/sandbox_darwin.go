@@ -1,5 +1,10 @@
 package runtime
 
+import (
+	"context"
+	"io"
+)
+
 /*
 import (
 	"fmt"
@@ -32,13 +37,8 @@ const SANDBOX_TEMPLATE = `
 (allow network*)
 `
 
-type SandboxParameters struct {
-	WorkspacePath string
-	ToolsDir      string
-}
-
 // TODO Implement sandbox
-func ExecInSandbox(command string, workingDir string) error {
+func ExecInSandbox(ctx context.Context, params SandboxParameters, command string, workingDir string, env []string, output io.Writer) error {
 	/* Temporarily disabled
 	workspace := LoadWorkspace()
 	sandboxFile, err := ioutil.TempFile("", "sandbox-*")
@@ -63,6 +63,6 @@ func ExecInSandbox(command string, workingDir string) error {
 	return runtime.ExecToStdout(sandboxedCommand, workingDir)
 	*/
 
-	return nil
+	return ErrSandboxUnsupported
 	//return ExecToStdout(command, workingDir)
 }
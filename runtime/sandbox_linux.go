@@ -1,8 +1,295 @@
 package runtime
 
-// TODO Implement sandbox
-// Currently just a passthrough
-func ExecInSandbox(command string, workingDir string) error {
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/google/shlex"
+	"github.com/yourbase/yb/plumbing/log"
+)
+
+// The sandbox is set up by re-executing yb under this name inside fresh user,
+// mount and (optionally) network namespaces. The re-executed process makes
+// the file system read-only except for the writable dirs, drops the
+// capabilities it needed for that and then execs the actual command.
+const (
+	sandboxInitName   = "yb-sandbox-init"
+	sandboxConfigVar  = "YB_SANDBOX_CONFIG"
+	capSysAdmin       = 21
+	prCapAmbient      = 47
+	prCapAmbientClear = 4
+)
+
+// Mount flags that have to be kept when remounting a bind mount inside a
+// user namespace, the kernel refuses to clear them, by the name
+// /proc/self/mountinfo lists them under. Mounts with neither relatime nor
+// noatime are strictatime.
+var lockedMountOptions = map[string]uintptr{
+	"nosuid":     syscall.MS_NOSUID,
+	"nodev":      syscall.MS_NODEV,
+	"noexec":     syscall.MS_NOEXEC,
+	"noatime":    syscall.MS_NOATIME,
+	"nodiratime": syscall.MS_NODIRATIME,
+	"relatime":   syscall.MS_RELATIME,
+}
+
+type sandboxConfig struct {
+	ReadOnly []string `json:"read_only"`
+	Writable []string `json:"writable"`
+	Args     []string `json:"args"`
+}
+
+func init() {
+	if len(os.Args) > 0 && os.Args[0] == sandboxInitName {
+		if err := sandboxInit(); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+			os.Exit(126)
+		}
+	}
+}
+
+// ExecInSandbox runs command in workingDir with the given environment, only
+// allowing it to write to the dirs in params. The user's home dir and the
+// root file system are mounted read-only, /tmp is replaced by an empty
+// tmpfs and, unless params allow it, the process has no network access.
+func ExecInSandbox(ctx context.Context, params SandboxParameters, command string, workingDir string, env []string, output io.Writer) error {
+	cmdArgs, err := shlex.Split(command)
+	if err != nil {
+		return fmt.Errorf("Can't parse command string '%s': %v", command, err)
+	}
+	if len(cmdArgs) == 0 {
+		return fmt.Errorf("Empty command")
+	}
+
+	config := sandboxConfig{
+		ReadOnly: []string{"/"},
+		Args:     cmdArgs,
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		config.ReadOnly = append(config.ReadOnly, home)
+	}
+	for _, dir := range params.writableDirs() {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		// They can't be created once the file system is read-only
+		if err := os.MkdirAll(abs, 0700); err != nil {
+			return err
+		}
+		config.Writable = append(config.Writable, abs)
+	}
+	configJson, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	cloneFlags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS)
+	if !params.AllowNetwork {
+		cloneFlags |= syscall.CLONE_NEWNET
+	}
+
+	cmd := exec.CommandContext(ctx, "/proc/self/exe")
+	cmd.Args = []string{sandboxInitName}
+	cmd.Dir = workingDir
+	cmd.Env = append(env, sandboxConfigVar+"="+string(configJson))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneFlags,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1},
+		},
+		AmbientCaps: []uintptr{capSysAdmin},
+	}
+
+	log.Infof("Running in sandbox: %s in %s", command, workingDir)
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("Command failed to run with error: %v", err)
+		}
+		return fmt.Errorf("Unable to start sandbox (are unprivileged user namespaces enabled?): %v", err)
+	}
+
+	return nil
+}
+
+func sandboxInit() error {
+	var config sandboxConfig
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxConfigVar)), &config); err != nil {
+		return fmt.Errorf("reading config: %v", err)
+	}
+	os.Unsetenv(sandboxConfigVar)
+
+	workDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+
+	for _, dir := range config.ReadOnly {
+		if err := bindMount(dir, true); err != nil {
+			return err
+		}
+	}
+
+	// Keep /tmp if one of the writable dirs lives there, otherwise hide it
+	tmpNeeded := false
+	for _, dir := range config.Writable {
+		if dir == "/tmp" || strings.HasPrefix(dir, "/tmp/") {
+			tmpNeeded = true
+		}
+	}
+	if !tmpNeeded {
+		if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("mounting /tmp: %v", err)
+		}
+	}
+
+	for _, dir := range config.Writable {
+		if err := bindMount(dir, false); err != nil {
+			return err
+		}
+	}
+
+	// Our working directory still refers to the mount it was on before
+	if err := os.Chdir(workDir); err != nil {
+		return err
+	}
+
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClear, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("dropping capabilities: %v", errno)
+	}
+
+	program, err := exec.LookPath(config.Args[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(program, config.Args, os.Environ())
+}
+
+// bindMount bind mounts dir onto itself, along with everything mounted below
+// it, so that they can be given their own mount flags, and remounts all of
+// them read-only or read-write. A bind mount starts out with the flags of the
+// mount it was taken from, so writable dirs below a read-only one need to be
+// remounted too. Mounts below a writable dir that can't be made writable stay
+// read-only.
+func bindMount(dir string, readOnly bool) error {
+	if err := syscall.Mount(dir, dir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mounting %s: %v", dir, err)
+	}
+
+	mounts, err := mountsUnder(dir)
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		flags := m.flags | syscall.MS_REMOUNT | syscall.MS_BIND
+		if readOnly {
+			flags |= syscall.MS_RDONLY
+		}
+		err := syscall.Mount("", m.path, "", flags, "")
+		switch {
+		case err == nil:
+		case m.path == dir:
+			return fmt.Errorf("remounting %s: %v", dir, err)
+		case err == syscall.ENOENT || err == syscall.EACCES:
+			// Gone by now, or out of reach for the command just the same
+		case !readOnly:
+			log.Debugf("Leaving %s read-only in the sandbox: %v", m.path, err)
+		default:
+			return fmt.Errorf("remounting %s: %v", m.path, err)
+		}
+	}
 	return nil
-	// return ExecToStdout(command, workingDir)
+}
+
+// mountPoint is a path something is mounted on, with the flags of the mount
+// that have to be kept when remounting it.
+type mountPoint struct {
+	path  string
+	flags uintptr
+}
+
+// mountsUnder lists the mount points at or below dir from
+// /proc/self/mountinfo, parents first. A path mounted on several times is
+// listed once, with the flags of the mount on top, as the others can't be
+// reached.
+func mountsUnder(dir string) ([]mountPoint, error) {
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("listing mounts: %v", err)
+	}
+	return parseMountInfo(string(data), dir), nil
+}
+
+func parseMountInfo(mountInfo string, dir string) []mountPoint {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	index := make(map[string]int)
+	mounts := make([]mountPoint, 0)
+	for _, line := range strings.Split(mountInfo, "\n") {
+		// ID, parent ID, major:minor, root, mount point, mount options, ...
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		mountPath := unescapeMountPath(fields[4])
+		if mountPath != dir && !strings.HasPrefix(mountPath, prefix) {
+			continue
+		}
+
+		var flags uintptr
+		atime := false
+		for _, option := range strings.Split(fields[5], ",") {
+			flags |= lockedMountOptions[option]
+			atime = atime || option == "relatime" || option == "noatime"
+		}
+		if !atime {
+			flags |= syscall.MS_STRICTATIME
+		}
+
+		if i, ok := index[mountPath]; ok {
+			mounts[i].flags = flags
+			continue
+		}
+		index[mountPath] = len(mounts)
+		mounts = append(mounts, mountPoint{path: mountPath, flags: flags})
+	}
+	return mounts
+}
+
+// unescapeMountPath decodes the octal escapes mountinfo uses for spaces,
+// tabs, newlines and backslashes in paths.
+func unescapeMountPath(p string) string {
+	if !strings.Contains(p, "\\") {
+		return p
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+3 < len(p) {
+			if n, err := strconv.ParseUint(p[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
 }
@@ -0,0 +1,119 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestExecInSandbox(t *testing.T) {
+	workspace, err := ioutil.TempDir("", "yb-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspace)
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+
+	var out bytes.Buffer
+	params := SandboxParameters{WorkspacePath: workspace}
+	err = ExecInSandbox(context.Background(), params, "touch allowed", workspace, os.Environ(), &out)
+	if err != nil && strings.Contains(err.Error(), "Unable to start sandbox") {
+		t.Skipf("user namespaces unavailable: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("writing to the workspace failed: %v\n%s", err, out.String())
+	}
+	if _, err := os.Stat(filepath.Join(workspace, "allowed")); err != nil {
+		t.Errorf("file in workspace wasn't written: %v", err)
+	}
+
+	forbidden := filepath.Join(home, ".yb-sandbox-test")
+	defer os.Remove(forbidden)
+	if err := ExecInSandbox(context.Background(), params, "touch "+forbidden, workspace, os.Environ(), &out); err == nil {
+		t.Error("writing to the home directory succeeded")
+	}
+	if _, err := os.Stat(forbidden); err == nil {
+		t.Error("file in home directory was written")
+	}
+}
+
+func TestExecInSandboxSubmounts(t *testing.T) {
+	// /dev/shm is a separate, writable mount below / on most systems
+	shm := "/dev/shm"
+	if !isMountPoint(t, shm) {
+		t.Skipf("%s isn't a mount point", shm)
+	}
+	escaped, err := ioutil.TempFile(shm, "yb-sandbox")
+	if err != nil {
+		t.Skipf("%s isn't writable: %v", shm, err)
+	}
+	escaped.Close()
+	os.Remove(escaped.Name())
+	defer os.Remove(escaped.Name())
+
+	workspace, err := ioutil.TempDir("", "yb-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspace)
+
+	var out bytes.Buffer
+	params := SandboxParameters{WorkspacePath: workspace}
+	err = ExecInSandbox(context.Background(), params, "touch "+escaped.Name(), workspace, os.Environ(), &out)
+	if err != nil && strings.Contains(err.Error(), "Unable to start sandbox") {
+		t.Skipf("user namespaces unavailable: %v", err)
+	}
+	if err == nil {
+		t.Errorf("writing to %s succeeded", shm)
+	}
+	if _, err := os.Stat(escaped.Name()); err == nil {
+		t.Errorf("file in %s was written", shm)
+	}
+}
+
+func isMountPoint(t *testing.T, dir string) bool {
+	mounts, err := mountsUnder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(mounts) > 0 && mounts[0].path == dir
+}
+
+func TestParseMountInfo(t *testing.T) {
+	mountInfo := `28 1 254:0 / / rw,relatime - ext4 /dev/vda rw
+25 28 0:6 / /dev rw,nosuid - devtmpfs devtmpfs rw
+26 25 0:24 / /dev/shm rw,nosuid,nodev,noexec,relatime - tmpfs tmpfs rw
+29 28 254:16 / /mnt/my\040data ro,noatime - ext4 /dev/vdb ro
+40 28 254:0 / / ro,nosuid,relatime - ext4 /dev/vda rw
+41 40 0:6 / /devices rw,relatime - devtmpfs devtmpfs rw
+`
+	got := parseMountInfo(mountInfo, "/dev")
+	want := []mountPoint{
+		{path: "/dev", flags: syscall.MS_NOSUID | syscall.MS_STRICTATIME},
+		{path: "/dev/shm", flags: syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_RELATIME},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMountInfo(/dev) = %+v, want %+v", got, want)
+	}
+
+	got = parseMountInfo(mountInfo, "/")
+	if len(got) != 5 {
+		t.Fatalf("parseMountInfo(/) = %+v, want 5 mount points", got)
+	}
+	if got[0].path != "/" || got[0].flags != syscall.MS_NOSUID|syscall.MS_RELATIME {
+		t.Errorf("root mount = %+v, want the flags of the mount on top", got[0])
+	}
+	if got[3].path != "/mnt/my data" || got[3].flags != syscall.MS_NOATIME {
+		t.Errorf("escaped mount = %+v", got[3])
+	}
+}
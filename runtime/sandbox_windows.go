@@ -1,8 +1,11 @@
 package runtime
 
+import (
+	"context"
+	"io"
+)
+
 // TODO Implement sandbox
-// Currently just a passthrough
-func ExecInSandbox(command string, workingDir string) error {
-	return nil
-	// return ExecToStdout(command, workingDir)
+func ExecInSandbox(ctx context.Context, params SandboxParameters, command string, workingDir string, env []string, output io.Writer) error {
+	return ErrSandboxUnsupported
 }
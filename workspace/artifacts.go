@@ -0,0 +1,177 @@
+package workspace
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yourbase/yb/plumbing/log"
+)
+
+// ArtifactManifestFile is written alongside the artifacts collected for a
+// target and describes each of them.
+const ArtifactManifestFile = "artifacts.json"
+
+type ArtifactManifest struct {
+	Target    string     `json:"target"`
+	Artifacts []Artifact `json:"artifacts"`
+}
+
+type Artifact struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// collectArtifacts copies every file matching the target's artifact globs,
+// resolved relative to srcDir, into outputDir and writes an artifact
+// manifest there. Anything left in outputDir from an earlier build is removed
+// first, keeping outputDir itself, which may be mounted in other containers. It fails if one of the globs doesn't match anything. Files reached
+// through symbolic links are only collected if they are inside srcDir, and
+// links to directories aren't followed.
+func (bt BuildTarget) collectArtifacts(srcDir string, outputDir string) (ArtifactManifest, error) {
+	manifest := ArtifactManifest{Target: bt.Name, Artifacts: make([]Artifact, 0)}
+
+	realSrcDir, err := filepath.EvalSymlinks(srcDir)
+	if err != nil {
+		return manifest, err
+	}
+
+	files := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, pattern := range bt.Artifacts {
+		matches, err := expandGlob(srcDir, pattern)
+		if err != nil {
+			return manifest, fmt.Errorf("Invalid artifact pattern '%s': %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return manifest, fmt.Errorf("Artifact '%s' declared by target '%s' was not found", pattern, bt.Name)
+		}
+
+		for _, match := range matches {
+			if match == ".." || strings.HasPrefix(match, "../") {
+				return manifest, fmt.Errorf("Artifact '%s' is outside of the package", match)
+			}
+
+			err := filepath.Walk(filepath.Join(srcDir, match), func(p string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(srcDir, p)
+				if err != nil {
+					return err
+				}
+				// The file itself or a directory above it may be a link
+				if ok, err := insideDir(realSrcDir, p); err != nil {
+					return err
+				} else if !ok {
+					log.Warnf("Skipping artifact %s, it links to outside of %s", rel, srcDir)
+					return nil
+				}
+				if info.Mode()&os.ModeSymlink != 0 {
+					if target, err := os.Stat(p); err != nil {
+						return err
+					} else if target.IsDir() {
+						log.Warnf("Skipping artifact %s, it links to a directory", rel)
+						return nil
+					}
+				}
+				if !seen[rel] {
+					seen[rel] = true
+					files = append(files, rel)
+				}
+				return nil
+			})
+			if err != nil {
+				return manifest, fmt.Errorf("Unable to read artifact '%s': %v", match, err)
+			}
+		}
+	}
+
+	// Build containers of downstream targets have the directory mounted, so
+	// it has to stay
+	entries, err := ioutil.ReadDir(outputDir)
+	if err != nil && !os.IsNotExist(err) {
+		return manifest, fmt.Errorf("Unable to clean artifact dir %s: %v", outputDir, err)
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(outputDir, entry.Name())); err != nil {
+			return manifest, fmt.Errorf("Unable to clean artifact dir %s: %v", outputDir, err)
+		}
+	}
+
+	for _, rel := range files {
+		artifact, err := copyArtifact(filepath.Join(srcDir, rel), filepath.Join(outputDir, rel))
+		if err != nil {
+			return manifest, fmt.Errorf("Unable to collect artifact '%s': %v", rel, err)
+		}
+		artifact.Path = filepath.ToSlash(rel)
+		manifest.Artifacts = append(manifest.Artifacts, artifact)
+		log.Infof("Collected artifact %s (%d bytes)", artifact.Path, artifact.Size)
+	}
+
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return manifest, err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outputDir, ArtifactManifestFile), data, 0644); err != nil {
+		return manifest, fmt.Errorf("Unable to write artifact manifest: %v", err)
+	}
+
+	return manifest, nil
+}
+
+// insideDir reports whether p, with all symbolic links resolved, is inside
+// dir, which has to have its links resolved already.
+func insideDir(dir string, p string) (bool, error) {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(dir, real)
+	if err != nil {
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+func copyArtifact(src string, dst string) (Artifact, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return Artifact{}, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return Artifact{}, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return Artifact{}, err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return Artifact{}, err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, h), in)
+	if err != nil {
+		return Artifact{}, err
+	}
+	if err := out.Close(); err != nil {
+		return Artifact{}, err
+	}
+
+	return Artifact{Size: size, SHA256: fmt.Sprintf("%x", h.Sum(nil))}, nil
+}
@@ -0,0 +1,175 @@
+package workspace
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCollectArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "pkg")
+	outputDir := filepath.Join(dir, "output", "pkg", "default")
+	files := map[string]string{
+		"bin/app":             "binary",
+		"reports/unit.xml":    "<unit/>",
+		"reports/sub/int.xml": "<int/>",
+		"reports/notes.txt":   "ignored",
+	}
+	for name, contents := range files {
+		p := filepath.Join(srcDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := BuildTarget{Name: "default", Artifacts: []string{"bin", "reports/**/*.xml"}}
+	manifest, err := target.collectArtifacts(srcDir, outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make([]string, 0)
+	for _, a := range manifest.Artifacts {
+		paths = append(paths, a.Path)
+		data, err := ioutil.ReadFile(filepath.Join(outputDir, filepath.FromSlash(a.Path)))
+		if err != nil {
+			t.Errorf("artifact %s wasn't copied: %v", a.Path, err)
+			continue
+		}
+		if int64(len(data)) != a.Size {
+			t.Errorf("artifact %s size = %d, want %d", a.Path, a.Size, len(data))
+		}
+		if sum := fmt.Sprintf("%x", sha256.Sum256(data)); sum != a.SHA256 {
+			t.Errorf("artifact %s sha256 = %s, want %s", a.Path, a.SHA256, sum)
+		}
+	}
+	wantPaths := []string{"bin/app", "reports/sub/int.xml", "reports/unit.xml"}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("artifacts = %v, want %v", paths, wantPaths)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(outputDir, ArtifactManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written ArtifactManifest
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written, manifest) {
+		t.Errorf("written manifest = %+v, want %+v", written, manifest)
+	}
+
+	// Building again replaces the artifacts, but not the directory holding
+	// them, which downstream containers have mounted
+	before, err := os.Stat(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(srcDir, "reports")); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := BuildTarget{Name: "default", Artifacts: []string{"bin"}}
+	if _, err := rebuilt.collectArtifacts(srcDir, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("collectArtifacts replaced the output directory")
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "reports")); !os.IsNotExist(err) {
+		t.Errorf("artifacts of the earlier build are still around: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "bin", "app")); err != nil {
+		t.Errorf("artifact bin/app wasn't copied again: %v", err)
+	}
+
+	missing := BuildTarget{Name: "default", Artifacts: []string{"dist/*.tar.gz"}}
+	if _, err := missing.collectArtifacts(srcDir, outputDir); err == nil {
+		t.Error("collectArtifacts succeeded with a missing artifact")
+	}
+}
+
+func TestCollectArtifactsSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "pkg")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(srcDir, "dist"), outside} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "dist", "app"), []byte("binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"dist/alias":  filepath.Join(srcDir, "dist", "app"),
+		"dist/secret": filepath.Join(outside, "secret"),
+		"dist/etc":    outside,
+		"escape":      outside,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(srcDir, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outputDir := filepath.Join(dir, "output")
+	target := BuildTarget{Name: "default", Artifacts: []string{"dist", "escape/*"}}
+	manifest, err := target.collectArtifacts(srcDir, outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, 0)
+	for _, a := range manifest.Artifacts {
+		paths = append(paths, a.Path)
+	}
+	if want := []string{"dist/alias", "dist/app"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("artifacts = %v, want %v", paths, want)
+	}
+}
+
+func TestTargetOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ws := &Workspace{Path: dir}
+	api := Package{Name: "api", Workspace: ws}
+	protos := Package{Name: "protos", Workspace: ws}
+
+	want := filepath.Join(ws.BuildRoot(), "output", "api", "default")
+	if got := api.TargetOutputDir("default"); got != want {
+		t.Errorf("TargetOutputDir(default) = %s, want %s", got, want)
+	}
+	if api.TargetOutputDir("default") == protos.TargetOutputDir("default") {
+		t.Error("targets of the same name in different packages share an output dir")
+	}
+}
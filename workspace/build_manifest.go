@@ -5,18 +5,26 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"sort"
 	"strings"
 	"text/template"
 
-	"github.com/joho/godotenv"
 	"github.com/yourbase/narwhal"
-	"github.com/yourbase/yb/plumbing"
 	"github.com/yourbase/yb/plumbing/log"
 	"github.com/yourbase/yb/runtime"
 )
 
 const DependencyChecksumLength = 12
 
+// Values for a build target's tools_mode
+const (
+	// ToolsModeMerge adds a target's tools to the manifest's build
+	// dependencies, overriding the version of tools listed in both.
+	ToolsModeMerge = "merge"
+	// ToolsModeReplace uses only the target's tools.
+	ToolsModeReplace = "replace"
+)
+
 type CIInfo struct {
 	CIBuilds []CIBuild `yaml:"builds"`
 }
@@ -49,80 +57,76 @@ type ExecPhase struct {
 	Dependencies ExecDependencies            `yaml:"dependencies"`
 	Container    narwhal.ContainerDefinition `yaml:"container"`
 	Commands     []string                    `yaml:"commands"`
+	Processes    map[string]string           `yaml:"processes"`
 	Ports        []string                    `yaml:"ports"`
-	Environment  map[string][]string         `yaml:"environment"`
+	Environment  EnvironmentSet              `yaml:"environment"`
+	EnvFiles     []EnvFile                   `yaml:"env_files"`
 	LogFiles     []string                    `yaml:"logfiles"`
 	Sandbox      bool                        `yaml:"sandbox"`
 	HostOnly     bool                        `yaml:"host_only"`
 	BuildFirst   []string                    `yaml:"build_first"`
+	WatchIgnore  []string                    `yaml:"watch_ignore"`
 }
 
+// EnvironmentVariables returns the variables of the default environment,
+// the IPs of the dependency containers and the variables of the named
+// environment, later ones overriding earlier ones.
 func (e *ExecPhase) EnvironmentVariables(ctx context.Context, envName string, data runtime.RuntimeEnvironmentData) []string {
-
-	result := make([]string, 0)
-
-	for _, property := range e.Environment["default"] {
-
-		if _, _, ok := plumbing.SaneEnvironmentVar(property); ok {
-			interpolated, err := TemplateToString(property, data)
-			if err == nil {
-				result = append(result, interpolated)
-			} else {
-				result = append(result, property)
-			}
-		}
-	}
-
+	containerEnv := make([]string, 0)
 	for k, v := range data.Containers.Environment(ctx) {
-		result = append(result, k, v)
+		containerEnv = append(containerEnv, strings.Join([]string{k, v}, "="))
 	}
+	sort.Strings(containerEnv)
 
-	if envName != "default" {
-		for _, property := range e.Environment[envName] {
-			if _, _, ok := plumbing.SaneEnvironmentVar(property); ok {
-				result = append(result, property)
-			}
-		}
-	}
+	return mergeEnvironment(
+		e.Environment.interpolated(DefaultEnvironment, data),
+		containerEnv,
+		e.Environment.interpolated(envName, data),
+	)
+}
 
-	// Check for local .env file
-	err := godotenv.Load()
-	if err == nil {
-		localEnv, _ := godotenv.Read()
-		for k, v := range localEnv {
-			result = append(result, strings.Join([]string{k, v}, "="))
-		}
-	}
+// DefaultExecEnvFile is loaded, if it exists, when the exec phase doesn't
+// list any env files.
+const DefaultExecEnvFile = ".env"
 
-	return result
+// ExecEnvFiles returns the env files of the exec phase.
+func (e *ExecPhase) ExecEnvFiles() []EnvFile {
+	if len(e.EnvFiles) == 0 {
+		return []EnvFile{{Path: DefaultExecEnvFile, Optional: true}}
+	}
+	return e.EnvFiles
 }
 
 type ExecDependencies struct {
-	Containers map[string]narwhal.ContainerDefinition `yaml:"containers"`
+	Containers map[string]DependencyContainer `yaml:"containers"`
 }
 
+// ContainerList returns the labelled container definitions in the order
+// they are started in.
 func (b ExecDependencies) ContainerList() []narwhal.ContainerDefinition {
-	containers := make([]narwhal.ContainerDefinition, 0)
-	for label, c := range b.Containers {
-		c.Label = label
-		containers = append(containers, c)
-	}
-	return containers
+	return containerList(b.Containers)
 }
 
 type BuildManifest struct {
 	Dependencies DependencySet `yaml:"dependencies"`
 	Sandbox      bool          `yaml:"sandbox"`
-	BuildTargets []BuildTarget `yaml:"build_targets"`
-	Build        BuildTarget   `yaml:"build"`
-	Exec         ExecPhase     `yaml:"exec"`
-	Package      PackagePhase  `yaml:"package"`
-	CI           CIInfo        `yaml:"ci"`
+	// SandboxNetwork allows every sandboxed target to use the network
+	SandboxNetwork bool          `yaml:"sandbox_network"`
+	Secrets        []Secret      `yaml:"secrets"`
+	BuildTargets   []BuildTarget `yaml:"build_targets"`
+	Build          BuildTarget   `yaml:"build"`
+	Exec           ExecPhase     `yaml:"exec"`
+	Package        PackagePhase  `yaml:"package"`
+	CI             CIInfo        `yaml:"ci"`
 }
 
 func (b BuildManifest) BuildDependenciesChecksum() string {
+	return dependenciesChecksum(b.Dependencies.Build)
+}
+
+func dependenciesChecksum(deps []string) string {
 	buf := bytes.Buffer{}
-	for _, dep := range b.Dependencies.Build {
+	for _, dep := range deps {
 		buf.Write([]byte(dep))
 	}
 
@@ -130,30 +134,100 @@ func (b BuildManifest) BuildDependenciesChecksum() string {
 	return fmt.Sprintf("%x", sum[:DependencyChecksumLength])
 }
 
+// TargetBuildTools returns the tool specs that need to be installed to build
+// target, combining the target's tools with the manifest's build
+// dependencies according to the target's tools_mode.
+func (b BuildManifest) TargetBuildTools(target BuildTarget) ([]string, error) {
+	switch target.ToolsMode {
+	case "", ToolsModeMerge:
+	case ToolsModeReplace:
+		return target.Tools, nil
+	default:
+		return nil, fmt.Errorf("Target '%s' has unknown tools_mode '%s' (expected '%s' or '%s')", target.Name, target.ToolsMode, ToolsModeMerge, ToolsModeReplace)
+	}
+
+	tools := make([]string, 0, len(b.Dependencies.Build)+len(target.Tools))
+	position := make(map[string]int)
+	for _, spec := range append(append([]string{}, b.Dependencies.Build...), target.Tools...) {
+		name, _ := splitToolSpec(spec)
+		if i, exists := position[name]; exists {
+			tools[i] = spec
+			continue
+		}
+		position[name] = len(tools)
+		tools = append(tools, spec)
+	}
+
+	return tools, nil
+}
+
 func (b BuildManifest) IsTargetSandboxed(target BuildTarget) bool {
 	return b.Sandbox || target.Sandbox
 }
 
-// XXX: Support more than one level? Intuitively that seems like it will breed un-needed complexity
-func (b BuildManifest) ResolveBuildTargets(targetName string) ([]BuildTarget, error) {
+func (b BuildManifest) IsTargetNetworkAllowed(target BuildTarget) bool {
+	return b.SandboxNetwork || target.SandboxNetwork
+}
+
+// ResolveBuildTargets returns the named targets along with every target they
+// depend on through build_after, directly or transitively. Targets are
+// ordered so that each one comes after all of its dependencies, and shared
+// dependencies are only listed once. Matrix targets are replaced by one
+// target per combination, and depending on a matrix target means depending
+// on all of them. References to targets of other packages are left to
+// Package.Build.
+func (b BuildManifest) ResolveBuildTargets(targetNames ...string) ([]BuildTarget, error) {
 	targetList := make([]BuildTarget, 0)
 
-	target, err := b.BuildTarget(targetName)
-	if err != nil {
-		return targetList, err
+	targets := make(map[string]BuildTarget)
+	matrices := make(map[string][]string)
+	for _, target := range b.BuildTargets {
+		expanded, err := target.expandMatrix(b.Dependencies.Build)
+		if err != nil {
+			return targetList, err
+		}
+		for _, t := range expanded {
+			targets[t.Name] = t
+		}
+		if len(target.Matrix) > 0 {
+			for _, t := range expanded {
+				matrices[target.Name] = append(matrices[target.Name], t.Name)
+			}
+		}
 	}
 
-	if len(target.BuildAfter) > 0 {
+	order, err := dependencyOrder(targetNames, func(name string) ([]string, error) {
+		if combinations, ok := matrices[name]; ok {
+			return combinations, nil
+		}
+		target, ok := targets[name]
+		if !ok {
+			return nil, fmt.Errorf("No such target '%s' in build manifest", name)
+		}
+		deps := make([]string, 0, len(target.BuildAfter))
 		for _, depName := range target.BuildAfter {
-			depTarget, err := b.BuildTarget(depName)
-			if err != nil {
-				return targetList, err
+			// Targets of other packages are resolved by Package.Build
+			if isPackageRef(depName) {
+				continue
 			}
-			targetList = append(targetList, depTarget)
+			_, isTarget := targets[depName]
+			_, isMatrix := matrices[depName]
+			if !isTarget && !isMatrix {
+				return nil, fmt.Errorf("Target '%s' depends on unknown target '%s'", name, depName)
+			}
+			deps = append(deps, depName)
 		}
+		return deps, nil
+	})
+	if err != nil {
+		return targetList, err
 	}
 
-	targetList = append(targetList, target)
+	for _, name := range order {
+		if _, ok := matrices[name]; !ok {
+			targetList = append(targetList, targets[name])
+		}
+	}
 
 	return targetList, nil
 }
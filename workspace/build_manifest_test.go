@@ -0,0 +1,154 @@
+package workspace
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func targetNames(targets []BuildTarget) []string {
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+func TestResolveBuildTargets(t *testing.T) {
+	manifest := BuildManifest{
+		BuildTargets: []BuildTarget{
+			{Name: "lint"},
+			{Name: "codegen", BuildAfter: []string{"lint"}},
+			{Name: "compile", BuildAfter: []string{"codegen"}},
+			{Name: "docs", BuildAfter: []string{"codegen"}},
+			{Name: "test", BuildAfter: []string{"compile", "docs"}},
+		},
+	}
+
+	tests := []struct {
+		target string
+		want   []string
+	}{
+		{target: "lint", want: []string{"lint"}},
+		{target: "compile", want: []string{"lint", "codegen", "compile"}},
+		{target: "test", want: []string{"lint", "codegen", "compile", "docs", "test"}},
+	}
+	for _, tt := range tests {
+		got, err := manifest.ResolveBuildTargets(tt.target)
+		if err != nil {
+			t.Fatalf("ResolveBuildTargets(%q): %v", tt.target, err)
+		}
+		if names := targetNames(got); !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("ResolveBuildTargets(%q) = %v, want %v", tt.target, names, tt.want)
+		}
+	}
+}
+
+func TestResolveBuildTargetsMultiple(t *testing.T) {
+	manifest := BuildManifest{
+		BuildTargets: []BuildTarget{
+			{Name: "codegen"},
+			{Name: "server", BuildAfter: []string{"codegen"}},
+			{Name: "worker", BuildAfter: []string{"codegen"}},
+		},
+	}
+
+	got, err := manifest.ResolveBuildTargets("server", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"codegen", "server", "worker"}
+	if names := targetNames(got); !reflect.DeepEqual(names, want) {
+		t.Errorf("ResolveBuildTargets(server, worker) = %v, want %v", names, want)
+	}
+}
+
+func TestBuildForExecUnknownTarget(t *testing.T) {
+	pkg := Package{
+		Name: "pkg",
+		Manifest: BuildManifest{
+			BuildTargets: []BuildTarget{{Name: "default"}},
+			Exec:         ExecPhase{BuildFirst: []string{"missing"}},
+		},
+	}
+
+	if err := pkg.BuildForExec(context.Background()); err == nil {
+		t.Error("BuildForExec succeeded with an unknown build_first target")
+	}
+}
+
+func TestResolveBuildTargetsCycle(t *testing.T) {
+	manifest := BuildManifest{
+		BuildTargets: []BuildTarget{
+			{Name: "default", BuildAfter: []string{"a"}},
+			{Name: "a", BuildAfter: []string{"b"}},
+			{Name: "b", BuildAfter: []string{"c"}},
+			{Name: "c", BuildAfter: []string{"a"}},
+		},
+	}
+
+	_, err := manifest.ResolveBuildTargets("default")
+	cycleErr, ok := err.(*DependencyCycleError)
+	if !ok {
+		t.Fatalf("ResolveBuildTargets error = %v, want *DependencyCycleError", err)
+	}
+	want := []string{"a", "b", "c", "a"}
+	if !reflect.DeepEqual(cycleErr.Path, want) {
+		t.Errorf("cycle path = %v, want %v", cycleErr.Path, want)
+	}
+}
+
+func TestResolveBuildTargetsUnknownDependency(t *testing.T) {
+	manifest := BuildManifest{
+		BuildTargets: []BuildTarget{
+			{Name: "default", BuildAfter: []string{"missing"}},
+		},
+	}
+
+	if _, err := manifest.ResolveBuildTargets("default"); err == nil {
+		t.Error("ResolveBuildTargets succeeded with an unknown dependency")
+	}
+}
+
+func TestTargetBuildTools(t *testing.T) {
+	manifest := BuildManifest{
+		Dependencies: DependencySet{
+			Build: []string{"go:1.14.4", "python:3.7"},
+		},
+	}
+
+	tests := []struct {
+		target BuildTarget
+		want   []string
+	}{
+		{
+			target: BuildTarget{Name: "default"},
+			want:   []string{"go:1.14.4", "python:3.7"},
+		},
+		{
+			target: BuildTarget{Name: "docs", Tools: []string{"python:3.8"}},
+			want:   []string{"go:1.14.4", "python:3.8"},
+		},
+		{
+			target: BuildTarget{Name: "mobile", Tools: []string{"flutter", "androidsdk"}},
+			want:   []string{"go:1.14.4", "python:3.7", "flutter", "androidsdk"},
+		},
+		{
+			target: BuildTarget{Name: "docs", Tools: []string{"python:3.8"}, ToolsMode: ToolsModeReplace},
+			want:   []string{"python:3.8"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := manifest.TargetBuildTools(tt.target)
+		if err != nil {
+			t.Fatalf("TargetBuildTools(%s): %v", tt.target.Name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("TargetBuildTools(%s) = %v, want %v", tt.target.Name, got, tt.want)
+		}
+	}
+
+	if _, err := manifest.TargetBuildTools(BuildTarget{Name: "bad", ToolsMode: "append"}); err == nil {
+		t.Error("TargetBuildTools accepted an unknown tools_mode")
+	}
+}
@@ -0,0 +1,199 @@
+package workspace
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yourbase/narwhal"
+	"github.com/yourbase/yb/plumbing"
+	"github.com/yourbase/yb/runtime"
+	"github.com/yourbase/yb/types"
+)
+
+// BuildPlan describes what building a target would do, without starting any
+// containers or running any commands.
+type BuildPlan struct {
+	Package     string       `json:"package"`
+	Target      string       `json:"target"`
+	Environment string       `json:"environment"`
+	Jobs        int          `json:"jobs"`
+	Targets     []TargetPlan `json:"targets"`
+}
+
+type TargetPlan struct {
+	Name         string          `json:"name"`
+	BuildAfter   []string        `json:"build_after,omitempty"`
+	HostOnly     bool            `json:"host_only"`
+	Sandboxed    bool            `json:"sandboxed"`
+	UpToDate     bool            `json:"up_to_date"`
+	Tools        []string        `json:"tools"`
+	Container    *ContainerPlan  `json:"container,omitempty"`
+	Dependencies []ContainerPlan `json:"dependencies,omitempty"`
+	WorkDir      string          `json:"work_dir"`
+	Environment  []string        `json:"environment"`
+	Secrets      []string        `json:"secrets,omitempty"`
+	Commands     []string        `json:"commands"`
+	Artifacts    []string        `json:"artifacts,omitempty"`
+	OutputDir    string          `json:"output_dir,omitempty"`
+	Warnings     []string        `json:"warnings,omitempty"`
+}
+
+type ContainerPlan struct {
+	Label       string   `json:"label"`
+	Image       string   `json:"image"`
+	Mounts      []string `json:"mounts,omitempty"`
+	Ports       []string `json:"ports,omitempty"`
+	Environment []string `json:"environment,omitempty"`
+}
+
+func newContainerPlan(cd narwhal.ContainerDefinition) ContainerPlan {
+	image := cd.Image
+	if image == "" {
+		image = types.DEFAULT_YB_CONTAINER
+	}
+	return ContainerPlan{
+		Label:       cd.Label,
+		Image:       image,
+		Mounts:      cd.Mounts,
+		Ports:       cd.Ports,
+		Environment: cd.Environment,
+	}
+}
+
+// Plan resolves everything Build would need to build the named target and
+// returns it as a BuildPlan. Template expressions in environment variables
+// are interpolated as they would be before any container is up, so container
+// IPs come out empty.
+func (p Package) Plan(flags BuildFlags, targetName string) (BuildPlan, error) {
+	if targetName == "" {
+		targetName = "default"
+	}
+
+	plan := BuildPlan{
+		Package:     p.Name,
+		Target:      targetName,
+		Environment: flags.Environment,
+		Jobs:        flags.Jobs,
+		Targets:     make([]TargetPlan, 0),
+	}
+	if plan.Environment == "" {
+		plan.Environment = DefaultEnvironment
+	}
+	if plan.Jobs < 1 {
+		plan.Jobs = 1
+	}
+
+	// Targets of other packages come first, named like @package:target
+	upstream, err := p.upstreamBuilds([]string{targetName})
+	if err != nil {
+		return plan, err
+	}
+	for _, u := range upstream {
+		tgts, err := u.pkg.Manifest.ResolveBuildTargets(u.target)
+		if err != nil {
+			return plan, err
+		}
+		for _, tgt := range tgts {
+			tp, err := u.pkg.planTarget(flags, tgt)
+			if err != nil {
+				return plan, err
+			}
+			tp.Name = fmt.Sprintf("@%s:%s", u.pkg.Name, tp.Name)
+			plan.Targets = append(plan.Targets, tp)
+		}
+	}
+
+	tgts, err := p.Manifest.ResolveBuildTargets(targetName)
+	if err != nil {
+		return plan, err
+	}
+
+	for _, tgt := range tgts {
+		tp, err := p.planTarget(flags, tgt)
+		if err != nil {
+			return plan, err
+		}
+		plan.Targets = append(plan.Targets, tp)
+	}
+
+	return plan, nil
+}
+
+func (p Package) planTarget(flags BuildFlags, tgt BuildTarget) (TargetPlan, error) {
+	manifest := p.Manifest
+
+	tgt, tools, rootDir, err := p.prepareTarget(tgt)
+	if err != nil {
+		return TargetPlan{}, err
+	}
+
+	tp := TargetPlan{
+		Name:       tgt.Name,
+		BuildAfter: tgt.BuildAfter,
+		HostOnly:   tgt.HostOnly || flags.HostOnly,
+		Tools:      tools,
+		WorkDir:    rootDir,
+		Secrets:    manifest.SecretNames(),
+		Commands:   make([]string, 0, len(tgt.Commands)),
+		Artifacts:  tgt.Artifacts,
+	}
+	tp.Sandboxed = tp.HostOnly && tgt.Sandbox
+	tp.Environment = mergeEnvironment(tgt.envFileEnv, tgt.artifactEnv(tp.HostOnly), tgt.EnvironmentVariables(flags.Environment, runtime.RuntimeEnvironmentData{}))
+
+	// EnvironmentVariables quietly drops or passes through anything it can't
+	// use, which is exactly what a plan should point out
+	properties := append([]string{}, tgt.Environment[DefaultEnvironment]...)
+	if flags.Environment != DefaultEnvironment {
+		properties = append(properties, tgt.Environment[flags.Environment]...)
+	}
+	for _, property := range properties {
+		if _, _, ok := plumbing.SaneEnvironmentVar(property); !ok {
+			tp.Warnings = append(tp.Warnings, fmt.Sprintf("Ignoring invalid environment variable '%s'", property))
+		} else if _, err := TemplateToString(property, runtime.RuntimeEnvironmentData{}); err != nil {
+			tp.Warnings = append(tp.Warnings, fmt.Sprintf("Unable to interpolate '%s': %v", property, err))
+		}
+	}
+
+	if len(tgt.Inputs) > 0 && !flags.CleanBuild {
+		fingerprint, err := p.targetFingerprint(tgt, rootDir, tools, flags)
+		if err != nil {
+			return tp, err
+		}
+		tp.UpToDate = fingerprint != "" && p.targetUpToDate(tgt, rootDir, fingerprint)
+	}
+
+	if !tp.HostOnly {
+		cacheDir := p.targetCacheDir(tgt, tools)
+		// A plan doesn't pull images, so ~ can only be resolved with the
+		// image already here
+		home, err := tgt.containerHome(context.Background(), false)
+		if err != nil {
+			tp.Warnings = append(tp.Warnings, fmt.Sprintf("Assuming ~ in cache_paths is /root: %v", err))
+			home = "/root"
+		}
+		buildContainer, containerWorkDir, err := tgt.buildContainerDefinition(p.Path(), cacheDir, home)
+		if err != nil {
+			return tp, err
+		}
+		container := newContainerPlan(buildContainer)
+		tp.Container = &container
+		tp.WorkDir = containerWorkDir
+	}
+
+	for _, cd := range tgt.Dependencies.ContainerList() {
+		tp.Dependencies = append(tp.Dependencies, newContainerPlan(cd))
+	}
+
+	for _, cmdString := range tgt.Commands {
+		if flags.ExecPrefix != "" {
+			cmdString = flags.ExecPrefix + " " + cmdString
+		}
+		tp.Commands = append(tp.Commands, cmdString)
+	}
+
+	if len(tgt.Artifacts) > 0 {
+		tp.OutputDir = p.TargetOutputDir(tgt.Name)
+	}
+
+	return tp, nil
+}
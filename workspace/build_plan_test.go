@@ -0,0 +1,136 @@
+package workspace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkgDir := filepath.Join(dir, "pkg")
+	if err := os.MkdirAll(pkgDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := Package{
+		Name:      "pkg",
+		path:      pkgDir,
+		Workspace: &Workspace{Path: dir},
+		Manifest: BuildManifest{
+			Dependencies: DependencySet{Build: []string{"go:1.14.4"}},
+			BuildTargets: []BuildTarget{
+				{
+					Name:     "lint",
+					HostOnly: true,
+					Commands: []string{"golint ./..."},
+				},
+				{
+					Name:        "default",
+					Commands:    []string{"go build ./..."},
+					Environment: EnvironmentSet{"default": {"DB_HOST={{ .Containers.IP \"db\" }}", "MODE=release", "bogus"}},
+					Artifacts:   []string{"bin/*"},
+					BuildAfter:  []string{"lint"},
+				},
+			},
+		},
+	}
+
+	plan, err := pkg.Plan(BuildFlags{ExecPrefix: "time"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.Target != "default" || plan.Jobs != 1 {
+		t.Errorf("plan is for %s with %d jobs, want default with 1", plan.Target, plan.Jobs)
+	}
+	if len(plan.Targets) != 2 {
+		t.Fatalf("plan has %d targets, want 2", len(plan.Targets))
+	}
+
+	lint := plan.Targets[0]
+	if lint.Name != "lint" || lint.Container != nil || lint.WorkDir != pkgDir {
+		t.Errorf("lint plan = %+v, want it to run on the host in %s", lint, pkgDir)
+	}
+
+	build := plan.Targets[1]
+	if build.Container == nil {
+		t.Fatal("default target isn't planned to run in a container")
+	}
+	if build.Container.Image != "yourbase/yb_ubuntu:18.04" {
+		t.Errorf("container image = %s", build.Container.Image)
+	}
+	if build.WorkDir != "/workspace" {
+		t.Errorf("work dir = %s, want /workspace", build.WorkDir)
+	}
+	if want := []string{"DB_HOST=", "MODE=release"}; !reflect.DeepEqual(build.Environment, want) {
+		t.Errorf("environment = %q, want %q", build.Environment, want)
+	}
+	if len(build.Warnings) != 1 {
+		t.Errorf("warnings = %q, want one for the invalid variable", build.Warnings)
+	}
+	if want := []string{"time go build ./..."}; !reflect.DeepEqual(build.Commands, want) {
+		t.Errorf("commands = %q, want %q", build.Commands, want)
+	}
+	if build.OutputDir != pkg.TargetOutputDir("default") {
+		t.Errorf("output dir = %s", build.OutputDir)
+	}
+}
+
+func TestPlanUpToDate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkgDir := filepath.Join(dir, "pkg")
+	if err := os.MkdirAll(pkgDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pkgDir, "main.go"), []byte("package main\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sandboxing is switched on for the whole manifest, not the target
+	pkg := Package{
+		Name:      "pkg",
+		path:      pkgDir,
+		Workspace: &Workspace{Path: dir},
+		Manifest: BuildManifest{
+			Sandbox: true,
+			BuildTargets: []BuildTarget{
+				{Name: "default", HostOnly: true, Inputs: []string{"*.go"}, Commands: []string{"go build"}},
+			},
+		},
+	}
+	flags := BuildFlags{HostOnly: true}
+
+	// Record the fingerprint the way a successful build does
+	tgt, tools, rootDir, err := pkg.prepareTarget(pkg.Manifest.BuildTargets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := tgt.fingerprint(rootDir, tools, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pkg.recordFingerprint(tgt, fingerprint); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := pkg.Plan(flags, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp := plan.Targets[0]; !tp.UpToDate || !tp.Sandboxed {
+		t.Errorf("plan = %+v, want a sandboxed target that is up to date", tp)
+	}
+}
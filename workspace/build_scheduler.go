@@ -0,0 +1,117 @@
+package workspace
+
+import (
+	"context"
+
+	"github.com/yourbase/yb/plumbing/log"
+)
+
+type targetBuildFunc func(ctx context.Context, target BuildTarget) ([]CommandTimer, error)
+
+type targetBuildResult struct {
+	name   string
+	timers []CommandTimer
+	err    error
+}
+
+// runBuildGraph builds targets, which must be ordered so that dependencies
+// come first, running up to jobs targets at the same time. A target is only
+// started once every target it lists in build_after (and that is part of
+// targets) has finished successfully. After the first failure no new targets
+// are started, the context of the running ones is cancelled, and the first
+// error is returned once they have all stopped.
+func runBuildGraph(ctx context.Context, targets []BuildTarget, jobs int, build targetBuildFunc) ([]TargetTimer, error) {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	index := make(map[string]int, len(targets))
+	for i, t := range targets {
+		index[t.Name] = i
+	}
+
+	waitingOn := make([]int, len(targets))
+	dependents := make([][]int, len(targets))
+	for i, t := range targets {
+		for _, dep := range t.BuildAfter {
+			if j, ok := index[dep]; ok {
+				waitingOn[i]++
+				dependents[j] = append(dependents[j], i)
+			}
+		}
+	}
+
+	// ready is kept in manifest order so that, with a single job, targets run
+	// in exactly the order they were resolved.
+	ready := make([]int, 0, len(targets))
+	for i := range targets {
+		if waitingOn[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	results := make(chan targetBuildResult)
+	timers := make(map[string][]CommandTimer, len(targets))
+	running := 0
+	var buildErr error
+
+	for {
+		for buildErr == nil && running < jobs && len(ready) > 0 {
+			target := targets[ready[0]]
+			ready = ready[1:]
+			running++
+
+			go func(target BuildTarget) {
+				t, err := build(ctx, target)
+				results <- targetBuildResult{name: target.Name, timers: t, err: err}
+			}(target)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+		timers[result.name] = result.timers
+
+		if result.err != nil {
+			if buildErr == nil {
+				log.Errorf("Target '%s' failed: %v", result.name, result.err)
+				buildErr = result.err
+				cancel()
+			}
+			continue
+		}
+
+		for _, i := range dependents[index[result.name]] {
+			waitingOn[i]--
+			if waitingOn[i] == 0 {
+				ready = insertSorted(ready, i)
+			}
+		}
+	}
+
+	targetTimers := make([]TargetTimer, 0, len(timers))
+	for _, t := range targets {
+		if stepTimes, ok := timers[t.Name]; ok {
+			targetTimers = append(targetTimers, TargetTimer{Name: t.Name, Timers: stepTimes})
+		}
+	}
+
+	return targetTimers, buildErr
+}
+
+func insertSorted(list []int, v int) []int {
+	i := len(list)
+	for i > 0 && list[i-1] > v {
+		i--
+	}
+	list = append(list, 0)
+	copy(list[i+1:], list[i:])
+	list[i] = v
+	return list
+}
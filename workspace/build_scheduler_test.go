@@ -0,0 +1,82 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunBuildGraphOrder(t *testing.T) {
+	targets := []BuildTarget{
+		{Name: "lint"},
+		{Name: "unit"},
+		{Name: "docs"},
+		{Name: "release", BuildAfter: []string{"lint", "unit", "docs"}},
+	}
+
+	var mu sync.Mutex
+	finished := make(map[string]bool)
+	running, maxRunning := 0, 0
+
+	timers, err := runBuildGraph(context.Background(), targets, 2, func(ctx context.Context, target BuildTarget) ([]CommandTimer, error) {
+		mu.Lock()
+		for _, dep := range target.BuildAfter {
+			if !finished[dep] {
+				t.Errorf("%s started before its dependency %s finished", target.Name, dep)
+			}
+		}
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		finished[target.Name] = true
+		mu.Unlock()
+		return []CommandTimer{{Command: target.Name}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if maxRunning != 2 {
+		t.Errorf("ran %d targets at once, want 2", maxRunning)
+	}
+
+	names := make([]string, 0, len(timers))
+	for _, timer := range timers {
+		names = append(names, timer.Name)
+	}
+	want := []string{"lint", "unit", "docs", "release"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("timers for %v, want %v", names, want)
+	}
+}
+
+func TestRunBuildGraphFailure(t *testing.T) {
+	targets := []BuildTarget{
+		{Name: "a"},
+		{Name: "b", BuildAfter: []string{"a"}},
+	}
+	failure := errors.New("boom")
+
+	timers, err := runBuildGraph(context.Background(), targets, 4, func(ctx context.Context, target BuildTarget) ([]CommandTimer, error) {
+		if target.Name == "b" {
+			t.Error("b was built after its dependency failed")
+		}
+		return nil, failure
+	})
+	if err != failure {
+		t.Errorf("runBuildGraph error = %v, want %v", err, failure)
+	}
+	if len(timers) != 1 || timers[0].Name != "a" {
+		t.Errorf("timers = %v, want only a", timers)
+	}
+}
@@ -8,7 +8,10 @@ import (
 	"github.com/yourbase/yb/plumbing/log"
 	"github.com/yourbase/yb/runtime"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -25,55 +28,248 @@ type TargetTimer struct {
 }
 
 type BuildTarget struct {
-	Name         string                      `yaml:"name"`
-	Container    narwhal.ContainerDefinition `yaml:"container"`
-	Tools        []string                    `yaml:"tools"`
-	Commands     []string                    `yaml:"commands"`
-	Artifacts    []string                    `yaml:"artifacts"`
-	CachePaths   []string                    `yaml:"cache_paths"`
-	Sandbox      bool                        `yaml:"sandbox"`
-	HostOnly     bool                        `yaml:"host_only"`
-	Root         string                      `yaml:"root"`
-	Environment  []string                    `yaml:"environment"`
-	Tags         map[string]string           `yaml:"tags"`
-	BuildAfter   []string                    `yaml:"build_after"`
-	Dependencies BuildDependencies           `yaml:"dependencies"`
+	Name       string                      `yaml:"name"`
+	Container  narwhal.ContainerDefinition `yaml:"container"`
+	Tools      []string                    `yaml:"tools"`
+	ToolsMode  string                      `yaml:"tools_mode"`
+	Matrix     BuildMatrix                 `yaml:"matrix"`
+	Commands   []string                    `yaml:"commands"`
+	Artifacts  []string                    `yaml:"artifacts"`
+	Inputs     []string                    `yaml:"inputs"`
+	Outputs    []string                    `yaml:"outputs"`
+	CachePaths []string                    `yaml:"cache_paths"`
+	Sandbox    bool                        `yaml:"sandbox"`
+	// SandboxNetwork allows sandboxed targets to use the network
+	SandboxNetwork bool              `yaml:"sandbox_network"`
+	HostOnly       bool              `yaml:"host_only"`
+	Root           string            `yaml:"root"`
+	Environment    EnvironmentSet    `yaml:"environment"`
+	EnvFiles       []EnvFile         `yaml:"env_files"`
+	Tags           map[string]string `yaml:"tags"`
+	BuildAfter     []string          `yaml:"build_after"`
+	Dependencies   BuildDependencies `yaml:"dependencies"`
+
+	// KEY=value pairs of the manifest's secrets, set by Package.Build. They
+	// are kept out of the manifest and out of the target's fingerprint.
+	secretEnv []string
+	// Variables read from the target's env files by Package.Build
+	envFileEnv []string
+	// Artifacts of the targets of other packages the target depends on, set
+	// by Package.Build
+	upstreamArtifacts []upstreamArtifact
+	// Fingerprints of the targets of the package it builds after, set by
+	// Package.targetFingerprint
+	dependencyFingerprints []string
 }
 
 type BuildDependencies struct {
-	Containers map[string]narwhal.ContainerDefinition `yaml:"containers"`
+	Containers map[string]DependencyContainer `yaml:"containers"`
 }
 
+// ContainerList returns the labelled container definitions in the order
+// they are started in.
 func (b BuildDependencies) ContainerList() []narwhal.ContainerDefinition {
-	containers := make([]narwhal.ContainerDefinition, 0)
-	for label, c := range b.Containers {
-		c.Label = label
-		containers = append(containers, c)
+	return containerList(b.Containers)
+}
+
+// EnvironmentVariables returns the target's variables for the named
+// environment, merged on top of the default environment.
+func (bt BuildTarget) EnvironmentVariables(envName string, data runtime.RuntimeEnvironmentData) []string {
+	return bt.Environment.Variables(envName, data)
+}
+
+// artifactEnv returns the variables pointing the target at the artifacts of
+// the targets of other packages it depends on, on the host or in its
+// container.
+func (bt BuildTarget) artifactEnv(hostOnly bool) []string {
+	env := make([]string, 0, len(bt.upstreamArtifacts))
+	for _, a := range bt.upstreamArtifacts {
+		dir := a.ContainerDir
+		if hostOnly {
+			dir = a.HostDir
+		}
+		env = append(env, fmt.Sprintf("%s=%s", a.EnvVar(), dir))
 	}
-	return containers
+	return env
 }
 
-func (bt BuildTarget) EnvironmentVariables(data runtime.RuntimeEnvironmentData) []string {
-	result := make([]string, 0)
-	for _, property := range bt.Environment {
-		if _, _, ok := plumbing.SaneEnvironmentVar(property); ok {
-			interpolated, err := TemplateToString(property, data)
-			if err == nil {
-				result = append(result, interpolated)
-			} else {
-				result = append(result, property)
+// RootDir returns the target's root, the directory its commands run in,
+// as a clean slash-separated path relative to the package. It fails if the
+// root is absolute or points outside of the package.
+func (bt BuildTarget) RootDir() (string, error) {
+	root := path.Clean(filepath.ToSlash(bt.Root))
+	if path.IsAbs(root) || root == ".." || strings.HasPrefix(root, "../") {
+		return "", fmt.Errorf("Root '%s' of target '%s' must be a directory inside the package", bt.Root, bt.Name)
+	}
+	return root, nil
+}
+
+// HostRootDir returns the target's root directory on the host, resolving
+// symbolic links so that a root can't escape the package through one.
+func (bt BuildTarget) HostRootDir(packagePath string) (string, error) {
+	root, err := bt.RootDir()
+	if err != nil {
+		return "", err
+	}
+
+	pkgDir, err := filepath.EvalSymlinks(packagePath)
+	if err != nil {
+		return "", err
+	}
+	rootDir, err := filepath.EvalSymlinks(filepath.Join(packagePath, filepath.FromSlash(root)))
+	if err != nil {
+		return "", fmt.Errorf("Root '%s' of target '%s': %v", bt.Root, bt.Name, err)
+	}
+	if rel, err := filepath.Rel(pkgDir, rootDir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Root '%s' of target '%s' must be a directory inside the package", bt.Root, bt.Name)
+	}
+
+	return filepath.Join(packagePath, filepath.FromSlash(root)), nil
+}
+
+// cachesHome reports whether any of the target's cache_paths is in the home
+// directory.
+func (bt BuildTarget) cachesHome() bool {
+	for _, cachePath := range bt.CachePaths {
+		if cachePath == "~" || strings.HasPrefix(cachePath, "~/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheMounts returns the mount specs that keep the target's cache_paths
+// between container builds, each backed by the directory under cacheDir at
+// the same path as in the container. Relative cache paths are relative to
+// workDir in the container and paths starting with ~ are relative to home,
+// the container user's home directory.
+func (bt BuildTarget) cacheMounts(cacheDir string, workDir string, home string) []string {
+	mounts := make([]string, 0, len(bt.CachePaths))
+	for _, cachePath := range bt.CachePaths {
+		containerPath := cachePath
+		switch {
+		case cachePath == "~":
+			containerPath = home
+		case strings.HasPrefix(cachePath, "~/"):
+			containerPath = path.Join(home, cachePath[2:])
+		case !path.IsAbs(cachePath):
+			containerPath = path.Join(workDir, cachePath)
+		}
+		containerPath = path.Clean(containerPath)
+		if containerPath == "/" {
+			log.Warnf("Not caching / for target %s", bt.Name)
+			continue
+		}
+
+		hostDir := filepath.Join(cacheDir, filepath.FromSlash(strings.TrimPrefix(containerPath, "/")))
+		mounts = append(mounts, fmt.Sprintf("%s:%s", hostDir, containerPath))
+	}
+	return mounts
+}
+
+// emptyCacheDirs removes what the host directories of cache mounts hold on a
+// clean build. The directories themselves are kept: a build container from
+// an earlier build may still have them mounted, and would be left with
+// deleted directories otherwise.
+func emptyCacheDirs(mounts []string) error {
+	mounted := make(map[string]bool)
+	// Directories on the way to a mounted one
+	keep := make(map[string]bool)
+	for _, mount := range mounts {
+		dir := filepath.Clean(strings.SplitN(mount, ":", 2)[0])
+		mounted[dir] = true
+		for d := dir; !keep[d]; d = filepath.Dir(d) {
+			keep[d] = true
+		}
+	}
+
+	var empty func(dir string) error
+	empty = func(dir string) error {
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			p := filepath.Join(dir, entry.Name())
+			switch {
+			case mounted[p]:
+				// Emptied on its own
+			case keep[p]:
+				err = empty(p)
+			default:
+				err = os.RemoveAll(p)
+			}
+			if err != nil {
+				return err
 			}
 		}
+		return nil
 	}
+	for dir := range mounted {
+		if err := empty(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return result
+// containerHome returns the home directory of the user the target's build
+// container runs as, which ~ in cache_paths stands for. The image is only
+// looked at if a cache path needs it.
+func (bt BuildTarget) containerHome(ctx context.Context, pull bool) (string, error) {
+	if !bt.cachesHome() || bt.Container.Image == "" {
+		return "/root", nil
+	}
+	return runtime.ContainerHome(ctx, bt.Container, pull)
 }
 
-func (bt BuildTarget) Build(ctx context.Context, runtimeCtx *runtime.Runtime, output io.Writer, flags BuildFlags, packagePath string, buildpacks []string) ([]CommandTimer, error) {
+// buildContainerDefinition returns the definition of the container the
+// target's commands run in, with the package and the cache paths mounted,
+// along with the directory inside of it that commands run from. home is the
+// container user's home directory.
+func (bt BuildTarget) buildContainerDefinition(packagePath string, cacheDir string, home string) (narwhal.ContainerDefinition, string, error) {
+	root, err := bt.RootDir()
+	if err != nil {
+		return narwhal.ContainerDefinition{}, "", err
+	}
+
+	buildContainer := bt.Container
+	buildContainer.Command = runtime.IdleCommand
+	buildContainer.Label = "build"
+
+	// Append build environment variables
+	buildContainer.Environment = []string{}
+
+	// Add package to mounts @ /workspace
+	sourceMapDir := "/workspace"
+	if buildContainer.WorkDir != "" {
+		sourceMapDir = buildContainer.WorkDir
+	}
+
+	mounts := append([]string{}, buildContainer.Mounts...)
+	mounts = append(mounts, fmt.Sprintf("%s:%s", packagePath, sourceMapDir))
+
+	containerWorkDir := path.Join(sourceMapDir, root)
+	mounts = append(mounts, bt.cacheMounts(cacheDir, containerWorkDir, home)...)
+	for _, a := range bt.upstreamArtifacts {
+		mounts = append(mounts, fmt.Sprintf("%s:%s", a.HostDir, a.ContainerDir))
+	}
+	buildContainer.Mounts = mounts
+
+	return buildContainer, containerWorkDir, nil
+}
+
+func (bt BuildTarget) Build(ctx context.Context, runtimeCtx *runtime.Runtime, output io.Writer, flags BuildFlags, packagePath string, cacheDir string, buildpacks []string) ([]CommandTimer, error) {
 	var stepTimes []CommandTimer
 
 	containers := bt.Dependencies.ContainerList()
-	workDir := packagePath
+	workDir, err := bt.HostRootDir(packagePath)
+	if err != nil {
+		return stepTimes, err
+	}
 	builder := runtimeCtx.DefaultTarget
 
 	hostOnly := bt.HostOnly || flags.HostOnly
@@ -81,26 +277,26 @@ func (bt BuildTarget) Build(ctx context.Context, runtimeCtx *runtime.Runtime, ou
 	if !hostOnly {
 		stepStartTime := time.Now()
 
-		buildContainer := bt.Container
-		buildContainer.Command = "/usr/bin/tail -f /dev/null"
-		buildContainer.Label = "build"
-
-		// Append build environment variables
-		buildContainer.Environment = []string{}
-
-		// Add package to mounts @ /workspace
-		sourceMapDir := "/workspace"
-		if buildContainer.WorkDir != "" {
-			sourceMapDir = buildContainer.WorkDir
+		home, err := bt.containerHome(ctx, true)
+		if err != nil {
+			return stepTimes, err
+		}
+		buildContainer, containerWorkDir, err := bt.buildContainerDefinition(packagePath, cacheDir, home)
+		if err != nil {
+			return stepTimes, err
+		}
+		if flags.CleanBuild && len(bt.CachePaths) > 0 {
+			log.Infof("Clean build, emptying cache in %s", cacheDir)
+			if err := emptyCacheDirs(bt.cacheMounts(cacheDir, containerWorkDir, home)); err != nil {
+				return stepTimes, fmt.Errorf("Unable to empty cache for target %s: %v", bt.Name, err)
+			}
+		}
+		for _, mount := range buildContainer.Mounts {
+			log.Infof("Will mount %s in container", mount)
 		}
-
-		log.Infof("Will mount  %s at %s in container", packagePath, sourceMapDir)
-		mount := fmt.Sprintf("%s:%s", packagePath, sourceMapDir)
-		buildContainer.Mounts = append(buildContainer.Mounts, mount)
 
 		containers = append(containers, buildContainer)
 
-		var err error
 		builder, err = runtimeCtx.AddContainer(ctx, buildContainer)
 
 		stepEndTime := time.Now()
@@ -122,7 +318,7 @@ func (bt BuildTarget) Build(ctx context.Context, runtimeCtx *runtime.Runtime, ou
 		stepStartTime = time.Now()
 
 		runtimeCtx.DefaultTarget = builder
-		workDir = sourceMapDir
+		workDir = containerWorkDir
 
 		// Inject a .ssh/config to skip host key checking
 		sshConfig := "Host github.com\n\tStrictHostKeyChecking no\n"
@@ -182,27 +378,26 @@ func (bt BuildTarget) Build(ctx context.Context, runtimeCtx *runtime.Runtime, ou
 	}
 
 	depContainerStartTime := time.Now()
-	// Setup dependent containers
-	for _, cd := range bt.Dependencies.ContainerList() {
-		if _, err := runtimeCtx.AddContainer(ctx, cd); err != nil {
-			errorTime := time.Now()
-			errorTotalTime := errorTime.Sub(depContainerStartTime)
-
-			log.Infof("When adding container %s, took %s", cd.Label, errorTotalTime)
-
-			errorTimer := CommandTimer{
-				Command:   "Starting dependencies (containers)",
-				StartTime: depContainerStartTime,
-				EndTime:   errorTime,
-			}
-			stepTimes = append(stepTimes, errorTimer)
+	// Setup dependent containers and wait for them to be ready
+	if err := startDependencies(ctx, runtimeCtx, bt.Dependencies.Containers, nil); err != nil {
+		errorTime := time.Now()
+		errorTotalTime := errorTime.Sub(depContainerStartTime)
+
+		log.Infof("When starting dependency containers, took %s", errorTotalTime)
 
-			return stepTimes, fmt.Errorf("can't add container %s: %v", cd.Label, err)
+		errorTimer := CommandTimer{
+			Command:   "Starting dependencies (containers)",
+			StartTime: depContainerStartTime,
+			EndTime:   errorTime,
 		}
+		stepTimes = append(stepTimes, errorTimer)
+
+		return stepTimes, err
 	}
 
 	// Do this after the containers are up
-	for _, envString := range bt.EnvironmentVariables(runtimeCtx.EnvironmentData()) {
+	targetEnv := append(bt.EnvironmentVariables(flags.Environment, runtimeCtx.EnvironmentData()), bt.secretEnv...)
+	for _, envString := range targetEnv {
 		if n, v, ok := plumbing.SaneEnvironmentVar(envString); ok {
 			builder.SetEnv(n, v)
 		} else {
@@ -226,6 +421,20 @@ func (bt BuildTarget) Build(ctx context.Context, runtimeCtx *runtime.Runtime, ou
 		return stepTimes, nil
 	}
 
+	var sandbox *runtime.SandboxParameters
+	if hostOnly && bt.Sandbox {
+		sandbox = &runtime.SandboxParameters{
+			WorkspacePath: packagePath,
+			ToolsDir:      builder.ToolsDir(ctx),
+			CacheDir:      builder.CacheDir(ctx),
+			AllowNetwork:  bt.SandboxNetwork,
+		}
+	}
+
+	// Env files and the paths to artifacts of other packages are only passed
+	// to the target's commands, with anything from environment overriding them
+	processEnv := mergeEnvironment(bt.envFileEnv, bt.artifactEnv(hostOnly), targetEnv)
+
 	for _, cmdString := range bt.Commands {
 		var stepError error
 
@@ -235,10 +444,12 @@ func (bt BuildTarget) Build(ctx context.Context, runtimeCtx *runtime.Runtime, ou
 
 		stepStartTime := time.Now()
 		p := runtime.Process{
-			Directory: workDir,
-			Command:   cmdString,
-			//Environment: buildData.environmentVariables(),
+			Directory:   workDir,
+			Command:     cmdString,
+			Environment: processEnv,
 			Interactive: false,
+			Output:      output,
+			Sandbox:     sandbox,
 		}
 
 		if stepError = builder.Run(ctx, p); stepError != nil {
@@ -0,0 +1,141 @@
+package workspace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCacheMounts(t *testing.T) {
+	target := BuildTarget{
+		Name:       "default",
+		CachePaths: []string{"~/.m2", "node_modules", "/var/cache/apt/", "~", "/a_b/c", "/a/b_c"},
+	}
+
+	got := target.cacheMounts("/ws/build/cache/pkg/default-abc", "/workspace", "/home/builder")
+	want := []string{
+		"/ws/build/cache/pkg/default-abc/home/builder/.m2:/home/builder/.m2",
+		"/ws/build/cache/pkg/default-abc/workspace/node_modules:/workspace/node_modules",
+		"/ws/build/cache/pkg/default-abc/var/cache/apt:/var/cache/apt",
+		"/ws/build/cache/pkg/default-abc/home/builder:/home/builder",
+		"/ws/build/cache/pkg/default-abc/a_b/c:/a_b/c",
+		"/ws/build/cache/pkg/default-abc/a/b_c:/a/b_c",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("cacheMounts() = %v, want %v", got, want)
+	}
+}
+
+func TestEmptyCacheDirs(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "yb-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	target := BuildTarget{
+		Name:       "default",
+		CachePaths: []string{"~/.m2", "node_modules", "node_modules/.cache"},
+	}
+	mounts := target.cacheMounts(cacheDir, "/workspace", "/root")
+	dirs := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		dirs = append(dirs, strings.SplitN(mount, ":", 2)[0])
+	}
+
+	// What a build leaves in the cache, with the mounted dirs as a build
+	// container sees them
+	build := func() []os.FileInfo {
+		infos := make([]os.FileInfo, 0, len(dirs))
+		for _, dir := range dirs {
+			if err := os.MkdirAll(filepath.Join(dir, "pkg"), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "pkg", "file"), []byte("cached"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			infos = append(infos, info)
+		}
+		return infos
+	}
+
+	before := build()
+	if err := emptyCacheDirs(mounts); err != nil {
+		t.Fatal(err)
+	}
+	for i, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatalf("Mounted dir %s was removed: %v", dir, err)
+		}
+		if !os.SameFile(before[i], info) {
+			t.Errorf("Mounted dir %s was replaced", dir)
+		}
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+		want := []string{}
+		if filepath.Base(dir) == "node_modules" {
+			// The nested cache path's dir stays
+			want = []string{".cache"}
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("%s holds %v after a clean build, want %v", dir, names, want)
+		}
+	}
+
+	// The next build writes to the same dirs again
+	after := build()
+	for i, dir := range dirs {
+		if !os.SameFile(before[i], after[i]) {
+			t.Errorf("Build after a clean build used a new %s", dir)
+		}
+	}
+	if err := emptyCacheDirs(mounts); err != nil {
+		t.Errorf("Second clean build: %v", err)
+	}
+}
+
+func TestRootDir(t *testing.T) {
+	tests := []struct {
+		root    string
+		want    string
+		wantErr bool
+	}{
+		{root: "", want: "."},
+		{root: "services/api", want: "services/api"},
+		{root: "./services/api/", want: "services/api"},
+		{root: "services/../tools", want: "tools"},
+		{root: "..", wantErr: true},
+		{root: "services/../../other", wantErr: true},
+		{root: "/etc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := BuildTarget{Name: "default", Root: tt.root}.RootDir()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("RootDir(%q) = %q, want error", tt.root, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("RootDir(%q): %v", tt.root, err)
+		} else if got != tt.want {
+			t.Errorf("RootDir(%q) = %q, want %q", tt.root, got, tt.want)
+		}
+	}
+}
@@ -17,13 +17,7 @@ func LoadBuildPacks(ctx context.Context, installTarget runtime.Target, dependenc
 
 	for _, toolSpec := range dependencies {
 
-		parts := strings.Split(toolSpec, ":")
-		buildpackName := parts[0]
-		versionString := ""
-
-		if len(parts) > 1 {
-			versionString = parts[1]
-		}
+		buildpackName, versionString := splitToolSpec(toolSpec)
 
 		spec := buildpacks.BuildToolSpec{
 			Tool:          buildpackName,
@@ -114,3 +108,14 @@ func LoadBuildPacks(ctx context.Context, installTarget runtime.Target, dependenc
 	return setupTimers, nil
 
 }
+
+// splitToolSpec splits a tool spec such as "go:1.14.4" into the build pack
+// name and the requested version, which may be empty.
+func splitToolSpec(toolSpec string) (name, version string) {
+	parts := strings.SplitN(toolSpec, ":", 2)
+	name = parts[0]
+	if len(parts) > 1 {
+		version = parts[1]
+	}
+	return
+}
@@ -0,0 +1,336 @@
+package workspace
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// CIEvent describes what triggered a CI build. A CI build's when condition is
+// evaluated against it.
+type CIEvent struct {
+	// Branch the build is for
+	Branch string
+	// Action that triggered the build, e.g. "push" or "pull_request"
+	Action string
+	// Tag that was pushed, if any
+	Tag string
+}
+
+// CICondition is a parsed when condition of a CI build. The language looks
+// like this:
+//
+//	branch is 'master' OR (action is 'pull_request' AND branch is not 'wip')
+//	tagged AND tag contains 'release'
+//
+// Conditions compare the variables branch, action and tag with quoted
+// strings using "is", "is not" and "contains", and can be combined with
+// AND, OR, NOT and parentheses. The boolean variable tagged is true when the
+// build is for a tag. Keywords are case-insensitive.
+type CICondition struct {
+	text string
+	root ciNode
+}
+
+// ParseCICondition parses a when condition. An empty condition always
+// matches.
+func ParseCICondition(text string) (*CICondition, error) {
+	tokens, err := tokenizeCICondition(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid condition '%s': %v", text, err)
+	}
+
+	cond := &CICondition{text: text}
+	if len(tokens) == 0 {
+		return cond, nil
+	}
+
+	p := &ciParser{tokens: tokens}
+	cond.root, err = p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %s", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid condition '%s': %v", text, err)
+	}
+	return cond, nil
+}
+
+// Matches reports whether the condition holds for the event.
+func (c *CICondition) Matches(event CIEvent) bool {
+	if c.root == nil {
+		return true
+	}
+	return c.root.eval(event)
+}
+
+func (c *CICondition) String() string {
+	return c.text
+}
+
+// Matches reports whether the CI build should run for the event.
+func (b CIBuild) Matches(event CIEvent) (bool, error) {
+	cond, err := ParseCICondition(b.When)
+	if err != nil {
+		return false, fmt.Errorf("CI build '%s': %v", b.Name, err)
+	}
+	return cond.Matches(event), nil
+}
+
+type ciTokenKind int
+
+const (
+	ciWord ciTokenKind = iota
+	ciString
+	ciLeftParen
+	ciRightParen
+)
+
+type ciToken struct {
+	kind  ciTokenKind
+	value string
+}
+
+func (t ciToken) String() string {
+	switch t.kind {
+	case ciString:
+		return fmt.Sprintf("string '%s'", t.value)
+	case ciLeftParen:
+		return "'('"
+	case ciRightParen:
+		return "')'"
+	default:
+		return fmt.Sprintf("'%s'", t.value)
+	}
+}
+
+// is reports whether the token is the given keyword.
+func (t ciToken) is(keyword string) bool {
+	return t.kind == ciWord && strings.EqualFold(t.value, keyword)
+}
+
+func tokenizeCICondition(text string) ([]ciToken, error) {
+	tokens := make([]ciToken, 0)
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, ciToken{kind: ciLeftParen})
+			i++
+		case r == ')':
+			tokens = append(tokens, ciToken{kind: ciRightParen})
+			i++
+		case r == '\'' || r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated string starting at offset %d", i)
+			}
+			tokens = append(tokens, ciToken{kind: ciString, value: string(runes[i+1 : end])})
+			i = end + 1
+		case isCIWordRune(r):
+			end := i
+			for end < len(runes) && isCIWordRune(runes[end]) {
+				end++
+			}
+			tokens = append(tokens, ciToken{kind: ciWord, value: string(runes[i:end])})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at offset %d", r, i)
+		}
+	}
+	return tokens, nil
+}
+
+func isCIWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+type ciNode interface {
+	eval(event CIEvent) bool
+}
+
+type ciOr struct{ left, right ciNode }
+
+func (n ciOr) eval(event CIEvent) bool { return n.left.eval(event) || n.right.eval(event) }
+
+type ciAnd struct{ left, right ciNode }
+
+func (n ciAnd) eval(event CIEvent) bool { return n.left.eval(event) && n.right.eval(event) }
+
+type ciNot struct{ node ciNode }
+
+func (n ciNot) eval(event CIEvent) bool { return !n.node.eval(event) }
+
+type ciComparison struct {
+	variable string
+	operator string
+	value    string
+}
+
+func (n ciComparison) eval(event CIEvent) bool {
+	actual := ciVariables[n.variable].value(event)
+	switch n.operator {
+	case "is":
+		return actual == n.value
+	case "is not":
+		return actual != n.value
+	case "contains":
+		return strings.Contains(actual, n.value)
+	}
+	return false
+}
+
+type ciFlag struct{ variable string }
+
+func (n ciFlag) eval(event CIEvent) bool {
+	return ciVariables[n.variable].value(event) == "true"
+}
+
+type ciVariable struct {
+	boolean bool
+	value   func(event CIEvent) string
+}
+
+var ciVariables = map[string]ciVariable{
+	"branch": {value: func(e CIEvent) string { return e.Branch }},
+	"action": {value: func(e CIEvent) string { return e.Action }},
+	"tag":    {value: func(e CIEvent) string { return e.Tag }},
+	"tagged": {boolean: true, value: func(e CIEvent) string { return fmt.Sprint(e.Tag != "") }},
+}
+
+type ciParser struct {
+	tokens []ciToken
+	pos    int
+}
+
+func (p *ciParser) peek() (ciToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return ciToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *ciParser) next() (ciToken, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, fmt.Errorf("unexpected end of condition")
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *ciParser) accept(keyword string) bool {
+	if t, ok := p.peek(); ok && t.is(keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *ciParser) parseOr() (ciNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = ciOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *ciParser) parseAnd() (ciNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = ciAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *ciParser) parseUnary() (ciNode, error) {
+	if p.accept("not") {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return ciNot{node}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *ciParser) parsePrimary() (ciNode, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.kind == ciLeftParen {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if closing.kind != ciRightParen {
+			return nil, fmt.Errorf("expected ')' but found %s", closing)
+		}
+		return node, nil
+	}
+
+	if t.kind != ciWord {
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+	name := strings.ToLower(t.value)
+	variable, ok := ciVariables[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable '%s'", t.value)
+	}
+
+	var operator string
+	switch {
+	case p.accept("is"):
+		operator = "is"
+		if p.accept("not") {
+			operator = "is not"
+		}
+	case p.accept("contains"):
+		operator = "contains"
+	default:
+		if variable.boolean {
+			return ciFlag{name}, nil
+		}
+		return nil, fmt.Errorf("expected 'is' or 'contains' after '%s'", t.value)
+	}
+
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case value.kind == ciString && !variable.boolean:
+	case (value.is("true") || value.is("false")) && variable.boolean && operator != "contains":
+		value.value = strings.ToLower(value.value)
+	default:
+		return nil, fmt.Errorf("can't compare '%s' with %s", t.value, value)
+	}
+
+	return ciComparison{variable: name, operator: operator, value: value.value}, nil
+}
@@ -0,0 +1,62 @@
+package workspace
+
+import (
+	"testing"
+)
+
+func TestCIConditionMatches(t *testing.T) {
+	push := CIEvent{Branch: "master", Action: "push"}
+	pr := CIEvent{Branch: "feature/login", Action: "pull_request"}
+	release := CIEvent{Branch: "master", Action: "push", Tag: "v1.2.0-release"}
+
+	tests := []struct {
+		when  string
+		event CIEvent
+		want  bool
+	}{
+		{when: "", event: pr, want: true},
+		{when: "branch is 'master'", event: push, want: true},
+		{when: "branch is 'master'", event: pr, want: false},
+		{when: "branch is 'master' OR action is 'pull_request'", event: pr, want: true},
+		{when: "branch is \"master\" and action is 'pull_request'", event: push, want: false},
+		{when: "branch IS NOT 'master'", event: pr, want: true},
+		{when: "branch contains 'feature/'", event: pr, want: true},
+		{when: "NOT (branch is 'master' OR tagged)", event: pr, want: true},
+		{when: "NOT (branch is 'master' OR tagged)", event: push, want: false},
+		{when: "tagged AND tag contains 'release'", event: release, want: true},
+		{when: "tagged is false", event: push, want: true},
+		{when: "action is 'push' AND branch is 'x' OR tagged", event: release, want: true},
+		{when: "action is 'pull_request' OR branch is 'master' AND tagged", event: push, want: false},
+	}
+	for _, tt := range tests {
+		cond, err := ParseCICondition(tt.when)
+		if err != nil {
+			t.Errorf("ParseCICondition(%q): %v", tt.when, err)
+			continue
+		}
+		if got := cond.Matches(tt.event); got != tt.want {
+			t.Errorf("%q matches %+v = %v, want %v", tt.when, tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestCIConditionErrors(t *testing.T) {
+	invalid := []string{
+		"branch",
+		"branch is",
+		"branch is master",
+		"branch is 'master",
+		"commit is 'abc'",
+		"tagged contains 'x'",
+		"tag is true",
+		"(branch is 'master'",
+		"branch is 'master' action is 'push'",
+		"branch is 'master' OR",
+		"branch == 'master'",
+	}
+	for _, when := range invalid {
+		if _, err := ParseCICondition(when); err == nil {
+			t.Errorf("ParseCICondition(%q) didn't fail", when)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yourbase/narwhal"
+	"github.com/yourbase/yb/plumbing/log"
+	"github.com/yourbase/yb/runtime"
+)
+
+const (
+	// Defaults for health checks that don't set a timeout or interval
+	defaultHealthCheckTimeout  = 60 * time.Second
+	defaultHealthCheckInterval = 1 * time.Second
+
+	// How many lines of a container's logs to show when it never gets ready
+	healthCheckLogLines = 20
+)
+
+// DependencyContainer is a container that has to be running for a build
+// target or the exec phase, like a database.
+type DependencyContainer struct {
+	narwhal.ContainerDefinition `yaml:",inline"`
+	// HealthCheck, if set, tells when the container is ready to be used
+	HealthCheck *HealthCheck `yaml:"healthcheck"`
+	// DependsOn lists the labels of containers that have to be ready before
+	// this one is started
+	DependsOn []string `yaml:"depends_on"`
+}
+
+// HealthCheck checks whether a dependency container is ready, by connecting
+// to a TCP port, requesting an HTTP URL or running a command in it. Exactly
+// one of them has to be set. Timeout and Interval are in seconds.
+type HealthCheck struct {
+	Port     int    `yaml:"port"`
+	URL      string `yaml:"url"`
+	Command  string `yaml:"command"`
+	Timeout  int    `yaml:"timeout"`
+	Interval int    `yaml:"interval"`
+}
+
+// dependencyTarget is what health checks need from a running container.
+type dependencyTarget interface {
+	Run(ctx context.Context, p runtime.Process) error
+	PortAddress(ctx context.Context, port int) (string, error)
+	RecentLogs(ctx context.Context, n int) (string, error)
+}
+
+// containerLevels groups the labels of containers by how deep they are in
+// the depends_on graph: the first level depends on nothing, and every other
+// one only on containers in earlier levels. Labels are sorted within a level.
+func containerLevels(containers map[string]DependencyContainer) ([][]string, error) {
+	labels := make([]string, 0, len(containers))
+	for label := range containers {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	order, err := dependencyOrder(labels, func(label string) ([]string, error) {
+		c, ok := containers[label]
+		if !ok {
+			return nil, fmt.Errorf("No such container '%s'", label)
+		}
+		for _, dep := range c.DependsOn {
+			if _, ok := containers[dep]; !ok {
+				return nil, fmt.Errorf("Container '%s' depends on unknown container '%s'", label, dep)
+			}
+		}
+		return c.DependsOn, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	depth := make(map[string]int)
+	levels := make([][]string, 0)
+	for _, label := range order {
+		level := 0
+		for _, dep := range containers[label].DependsOn {
+			if depth[dep]+1 > level {
+				level = depth[dep] + 1
+			}
+		}
+		depth[label] = level
+		if level == len(levels) {
+			levels = append(levels, nil)
+		}
+		levels[level] = append(levels[level], label)
+	}
+	for _, level := range levels {
+		sort.Strings(level)
+	}
+	return levels, nil
+}
+
+// containerList returns the definitions of containers, labelled and in the
+// order they are started in. If depends_on is broken they are ordered by
+// label; starting them reports the error.
+func containerList(containers map[string]DependencyContainer) []narwhal.ContainerDefinition {
+	levels, err := containerLevels(containers)
+	if err != nil {
+		labels := make([]string, 0, len(containers))
+		for label := range containers {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		levels = [][]string{labels}
+	}
+
+	result := make([]narwhal.ContainerDefinition, 0, len(containers))
+	for _, level := range levels {
+		for _, label := range level {
+			cd := containers[label].ContainerDefinition
+			cd.Label = label
+			result = append(result, cd)
+		}
+	}
+	return result
+}
+
+// startDependencies starts the containers in runtimeCtx, level by level as
+// given by containerLevels. The containers of a level are started in parallel
+// and have to pass their health checks before the next level is started.
+// prepare, if set, is called with the definition of each container before it
+// is started.
+func startDependencies(ctx context.Context, runtimeCtx *runtime.Runtime, containers map[string]DependencyContainer, prepare func(cd *narwhal.ContainerDefinition) error) error {
+	levels, err := containerLevels(containers)
+	if err != nil {
+		return err
+	}
+
+	for _, level := range levels {
+		errs := make([]error, len(level))
+		var wg sync.WaitGroup
+		for i, label := range level {
+			cd := containers[label].ContainerDefinition
+			cd.Label = label
+			if prepare != nil {
+				if err := prepare(&cd); err != nil {
+					return err
+				}
+			}
+
+			wg.Add(1)
+			go func(i int, cd narwhal.ContainerDefinition, check *HealthCheck) {
+				defer wg.Done()
+				errs[i] = startDependency(ctx, runtimeCtx, cd, check)
+			}(i, cd, containers[label].HealthCheck)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// startDependency starts a single container and waits for it to pass its
+// health check, if it has one.
+func startDependency(ctx context.Context, runtimeCtx *runtime.Runtime, cd narwhal.ContainerDefinition, check *HealthCheck) error {
+	specs := cd.Ports
+	if check != nil && runtime.HostOS() != runtime.Linux {
+		// The check can only reach the container through a local port when
+		// Docker doesn't run natively
+		if port := check.containerPort(cd.Label); port != 0 {
+			specs = append(specs[:len(specs):len(specs)], fmt.Sprintf("127.0.0.1::%d", port))
+		}
+	}
+	ports, err := hostPortMappings(specs)
+	if err != nil {
+		return fmt.Errorf("Container %s: %v", cd.Label, err)
+	}
+	cd.Ports = ports
+
+	if err := runtimeCtx.PullImage(ctx, cd); err != nil {
+		return fmt.Errorf("Unable to pull image for container %s: %v", cd.Label, err)
+	}
+
+	target, err := runtimeCtx.AddContainer(ctx, cd)
+	if err != nil {
+		return fmt.Errorf("Unable to start container %s: %v", cd.Label, err)
+	}
+
+	if check == nil {
+		return nil
+	}
+	return check.wait(ctx, cd.Label, target)
+}
+
+// wait runs the health check until it passes or times out. On time out the
+// error includes the container's most recent logs.
+func (h HealthCheck) wait(ctx context.Context, label string, target dependencyTarget) error {
+	if err := h.validate(); err != nil {
+		return fmt.Errorf("Container %s: %v", label, err)
+	}
+
+	timeout := defaultHealthCheckTimeout
+	if h.Timeout > 0 {
+		timeout = time.Duration(h.Timeout) * time.Second
+	}
+	interval := defaultHealthCheckInterval
+	if h.Interval > 0 {
+		interval = time.Duration(h.Interval) * time.Second
+	}
+
+	log.Infof("Waiting up to %s for container %s to be ready", timeout, label)
+	checkCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := h.check(checkCtx, label, target)
+		if err == nil {
+			log.Infof("Container %s is ready", label)
+			return nil
+		}
+		log.Debugf("Container %s isn't ready yet: %v", label, err)
+
+		select {
+		case <-ticker.C:
+		case <-checkCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logs, logErr := target.RecentLogs(context.Background(), healthCheckLogLines)
+			if logErr != nil {
+				logs = fmt.Sprintf("(unable to get logs: %v)", logErr)
+			}
+			return fmt.Errorf("Container %s didn't become ready within %s: %v\nRecent logs of %s:\n%s", label, timeout, err, label, logs)
+		}
+	}
+}
+
+func (h HealthCheck) validate() error {
+	set := 0
+	for _, ok := range []bool{h.Port != 0, h.URL != "", h.Command != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("healthcheck needs exactly one of port, url or command")
+	}
+	return nil
+}
+
+// containerPort returns the TCP port of the container the check connects to,
+// or 0 if it doesn't connect to the container from the host.
+func (h HealthCheck) containerPort(label string) int {
+	if h.Port != 0 {
+		return h.Port
+	}
+	u, err := url.Parse(h.URL)
+	if h.URL == "" || err != nil || u.Hostname() != label {
+		return 0
+	}
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return port
+	}
+	if u.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// check runs the health check once. A URL whose host is the label of the
+// container is requested from the address the container's port is reached
+// at.
+func (h HealthCheck) check(ctx context.Context, label string, target dependencyTarget) error {
+	switch {
+	case h.Port != 0:
+		addr, err := target.PortAddress(ctx, h.Port)
+		if err != nil {
+			return err
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case h.URL != "":
+		u, err := url.Parse(h.URL)
+		if err != nil {
+			return err
+		}
+		if u.Hostname() == label {
+			addr, err := target.PortAddress(ctx, h.containerPort(label))
+			if err != nil {
+				return err
+			}
+			u.Host = addr
+		}
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%s returned %s", u, resp.Status)
+		}
+		return nil
+
+	default:
+		var output bytes.Buffer
+		if err := target.Run(ctx, runtime.Process{Command: h.Command, Output: &output}); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(output.String()))
+		}
+		return nil
+	}
+}
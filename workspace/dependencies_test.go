@@ -0,0 +1,175 @@
+package workspace
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/yourbase/yb/runtime"
+)
+
+// fakeDependencyTarget is a container running on localhost.
+type fakeDependencyTarget struct {
+	exitCode int
+}
+
+func (t fakeDependencyTarget) Run(ctx context.Context, p runtime.Process) error {
+	if t.exitCode != 0 {
+		p.Output.Write([]byte("not yet\n"))
+		return &runtime.TargetRunError{ExitCode: t.exitCode, Message: "exit status 1"}
+	}
+	return nil
+}
+
+func (t fakeDependencyTarget) PortAddress(ctx context.Context, port int) (string, error) {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), nil
+}
+
+func (t fakeDependencyTarget) RecentLogs(ctx context.Context, n int) (string, error) {
+	return "database system is starting up\n", nil
+}
+
+func TestDependencyContainerYAML(t *testing.T) {
+	var deps BuildDependencies
+	err := yaml.Unmarshal([]byte(`
+containers:
+  db:
+    image: postgres:12
+    environment:
+      - POSTGRES_PASSWORD=secret
+    healthcheck:
+      command: pg_isready
+      timeout: 30
+`), &deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := deps.Containers["db"]
+	if db.Image != "postgres:12" || len(db.Environment) != 1 {
+		t.Errorf("container definition = %+v", db.ContainerDefinition)
+	}
+	if db.HealthCheck == nil || db.HealthCheck.Command != "pg_isready" || db.HealthCheck.Timeout != 30 {
+		t.Errorf("healthcheck = %+v", db.HealthCheck)
+	}
+	if list := deps.ContainerList(); len(list) != 1 || list[0].Label != "db" {
+		t.Errorf("ContainerList() = %+v", list)
+	}
+}
+
+func TestHealthCheckPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	check := HealthCheck{Port: l.Addr().(*net.TCPAddr).Port, Timeout: 1}
+	if err := check.wait(context.Background(), "db", fakeDependencyTarget{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHealthCheckURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	check := HealthCheck{URL: "http://api:" + strconv.Itoa(port) + "/health", Timeout: 1}
+	if err := check.wait(context.Background(), "api", fakeDependencyTarget{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	check := HealthCheck{Command: "pg_isready", Timeout: 1}
+	err := check.wait(context.Background(), "db", fakeDependencyTarget{exitCode: 1})
+	if err == nil {
+		t.Fatal("health check passed for a container that isn't ready")
+	}
+	if !strings.Contains(err.Error(), "database system is starting up") {
+		t.Errorf("error %q doesn't include the container's logs", err)
+	}
+}
+
+func TestHealthCheckInvalid(t *testing.T) {
+	check := HealthCheck{Port: 5432, Command: "pg_isready"}
+	if err := check.wait(context.Background(), "db", fakeDependencyTarget{}); err == nil {
+		t.Error("health check with both a port and a command passed")
+	}
+}
+
+func TestContainerLevels(t *testing.T) {
+	containers := map[string]DependencyContainer{
+		"app":    {DependsOn: []string{"db", "cache"}},
+		"db":     {},
+		"cache":  {},
+		"proxy":  {DependsOn: []string{"app"}},
+		"broker": {},
+	}
+
+	levels, err := containerLevels(containers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"broker", "cache", "db"}, {"app"}, {"proxy"}}
+	if !reflect.DeepEqual(levels, want) {
+		t.Errorf("containerLevels = %v, want %v", levels, want)
+	}
+
+	deps := ExecDependencies{Containers: containers}
+	labels := make([]string, 0)
+	for _, cd := range deps.ContainerList() {
+		labels = append(labels, cd.Label)
+	}
+	if want := []string{"broker", "cache", "db", "app", "proxy"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("ContainerList labels = %v, want %v", labels, want)
+	}
+}
+
+func TestContainerLevelsErrors(t *testing.T) {
+	_, err := containerLevels(map[string]DependencyContainer{
+		"app": {DependsOn: []string{"db"}},
+		"db":  {DependsOn: []string{"app"}},
+	})
+	if _, ok := err.(*DependencyCycleError); !ok {
+		t.Errorf("containerLevels error = %v, want *DependencyCycleError", err)
+	}
+
+	_, err = containerLevels(map[string]DependencyContainer{
+		"app": {DependsOn: []string{"missing"}},
+	})
+	if err == nil {
+		t.Error("containerLevels succeeded with an unknown dependency")
+	}
+}
+
+func TestHealthCheckContainerPort(t *testing.T) {
+	tests := []struct {
+		check HealthCheck
+		port  int
+	}{
+		{check: HealthCheck{Port: 5432}, port: 5432},
+		{check: HealthCheck{URL: "http://api:8080/health"}, port: 8080},
+		{check: HealthCheck{URL: "https://api/health"}, port: 443},
+		{check: HealthCheck{URL: "http://api/health"}, port: 80},
+		{check: HealthCheck{URL: "http://example.com/health"}, port: 0},
+		{check: HealthCheck{Command: "true"}, port: 0},
+	}
+	for _, tt := range tests {
+		if got := tt.check.containerPort("api"); got != tt.port {
+			t.Errorf("%+v.containerPort(api) = %d, want %d", tt.check, got, tt.port)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package workspace
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/yourbase/yb/plumbing"
+	"github.com/yourbase/yb/runtime"
+)
+
+// DefaultEnvironment is used when no environment is selected. Every other
+// environment is merged on top of it.
+const DefaultEnvironment = "default"
+
+// EnvironmentSet holds lists of KEY=value environment variables by
+// environment name. In YAML it is either such a map or just a list, which is
+// taken as the default environment.
+type EnvironmentSet map[string][]string
+
+func (e *EnvironmentSet) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*e = EnvironmentSet{DefaultEnvironment: list}
+		return nil
+	}
+
+	var envs map[string][]string
+	if err := unmarshal(&envs); err != nil {
+		return fmt.Errorf("environment must be a list of variables or a map of environment names to lists of variables")
+	}
+	*e = EnvironmentSet(envs)
+	return nil
+}
+
+// Variables returns the variables of the default environment with those of
+// the named one merged on top, after interpolating them with data.
+func (e EnvironmentSet) Variables(envName string, data runtime.RuntimeEnvironmentData) []string {
+	return mergeEnvironment(e.interpolated(DefaultEnvironment, data), e.interpolated(envName, data))
+}
+
+// interpolated returns the valid variables of a single environment with
+// template expressions filled in from data. Variables that fail to
+// interpolate are kept as they are.
+func (e EnvironmentSet) interpolated(envName string, data runtime.RuntimeEnvironmentData) []string {
+	result := make([]string, 0)
+	if envName == "" {
+		return result
+	}
+
+	for _, property := range e[envName] {
+		if _, _, ok := plumbing.SaneEnvironmentVar(property); ok {
+			interpolated, err := TemplateToString(property, data)
+			if err == nil {
+				result = append(result, interpolated)
+			} else {
+				result = append(result, property)
+			}
+		}
+	}
+	return result
+}
+
+// mergeEnvironment merges lists of KEY=value variables. A variable set in
+// more than one list takes the value from the last of them, but keeps the
+// position it first showed up at.
+func mergeEnvironment(envs ...[]string) []string {
+	result := make([]string, 0)
+	index := make(map[string]int)
+	for _, env := range envs {
+		for _, v := range env {
+			key := strings.SplitN(v, "=", 2)[0]
+			if i, ok := index[key]; ok {
+				result[i] = v
+				continue
+			}
+			index[key] = len(result)
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// EnvFile is a file of KEY=value lines to load variables from. In YAML it is
+// either just the path or a map with the path and whether the file is
+// optional.
+type EnvFile struct {
+	Path     string `yaml:"path"`
+	Optional bool   `yaml:"optional"`
+}
+
+func (f *EnvFile) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		*f = EnvFile{Path: path}
+		return nil
+	}
+
+	type plain EnvFile
+	return unmarshal((*plain)(f))
+}
+
+// readEnvFiles reads the env files, relative to packagePath, and returns
+// their variables. Variables in later files override those in earlier ones.
+// A missing file is an error unless it is optional.
+func readEnvFiles(packagePath string, files []EnvFile) ([]string, error) {
+	envs := make([][]string, 0, len(files))
+	for _, file := range files {
+		path := filepath.Join(packagePath, filepath.FromSlash(file.Path))
+		vars, err := godotenv.Read(path)
+		if os.IsNotExist(err) {
+			if file.Optional {
+				continue
+			}
+			return nil, fmt.Errorf("Env file '%s' not found in %s", file.Path, packagePath)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read env file '%s': %v", file.Path, err)
+		}
+
+		env := make([]string, 0, len(vars))
+		for k, v := range vars {
+			env = append(env, strings.Join([]string{k, v}, "="))
+		}
+		sort.Strings(env)
+		envs = append(envs, env)
+	}
+	return mergeEnvironment(envs...), nil
+}
@@ -0,0 +1,105 @@
+package workspace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yourbase/yb/runtime"
+	"gopkg.in/yaml.v2"
+)
+
+func TestEnvironmentSet(t *testing.T) {
+	var manifest BuildManifest
+	err := yaml.Unmarshal([]byte(`
+build_targets:
+  - name: unit
+    environment:
+      - MODE=test
+  - name: integration
+    environment:
+      default:
+        - API_URL=http://localhost:8080
+        - VERBOSE=1
+      staging:
+        - API_URL=https://staging.example.com
+        - FEATURE_X=on
+`), &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unit, _ := manifest.BuildTarget("unit")
+	if got, want := unit.EnvironmentVariables("staging", runtime.RuntimeEnvironmentData{}), []string{"MODE=test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unit in staging = %q, want %q", got, want)
+	}
+
+	integration, _ := manifest.BuildTarget("integration")
+	tests := []struct {
+		env  string
+		want []string
+	}{
+		{env: "", want: []string{"API_URL=http://localhost:8080", "VERBOSE=1"}},
+		{env: "default", want: []string{"API_URL=http://localhost:8080", "VERBOSE=1"}},
+		{env: "staging", want: []string{"API_URL=https://staging.example.com", "VERBOSE=1", "FEATURE_X=on"}},
+	}
+	for _, tt := range tests {
+		got := integration.EnvironmentVariables(tt.env, runtime.RuntimeEnvironmentData{})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("integration in %q = %q, want %q", tt.env, got, tt.want)
+		}
+	}
+
+	if err := yaml.Unmarshal([]byte("environment: FOO=bar"), &struct {
+		Environment EnvironmentSet `yaml:"environment"`
+	}{}); err == nil {
+		t.Error("a plain string was accepted as an environment")
+	}
+}
+
+func TestReadEnvFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-envfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "base.env"), []byte("A=1\nB=2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "config"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config", "local.env"), []byte("# overrides\nB=3\nC=\"with spaces\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var target BuildTarget
+	err = yaml.Unmarshal([]byte(`
+env_files:
+  - base.env
+  - path: missing.env
+    optional: true
+  - config/local.env
+`), &target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := readEnvFiles(dir, target.EnvFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"A=1", "B=3", "C=with spaces"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("readEnvFiles = %q, want %q", env, want)
+	}
+	if _, ok := os.LookupEnv("C"); ok {
+		t.Error("env file variables leaked into the process environment")
+	}
+
+	if _, err := readEnvFiles(dir, []EnvFile{{Path: "missing.env"}}); err == nil {
+		t.Error("readEnvFiles didn't fail on a missing file")
+	}
+}
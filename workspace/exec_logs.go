@@ -0,0 +1,137 @@
+package workspace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yourbase/yb/plumbing"
+	"github.com/yourbase/yb/plumbing/log"
+	"github.com/yourbase/yb/plumbing/redact"
+	"github.com/yourbase/yb/runtime"
+)
+
+// Log tails write their PID into this directory in the exec container, so
+// they can be stopped once exec is done.
+const logTailPidDir = "/tmp/yb-logfiles"
+
+// How long to wait for log tails to finish after stopping them
+const logTailStopTimeout = 5 * time.Second
+
+// tailLogFiles follows the exec phase's log files in target, relative to
+// workDir, and writes every new line to output prefixed with the name of the
+// file. tail -F keeps following files that don't exist yet or get rotated.
+// The returned function stops following them.
+func (p Package) tailLogFiles(ctx context.Context, target runtime.Target, workDir string, output io.Writer, outputLock *sync.Mutex) func() {
+	files := p.Manifest.Exec.LogFiles
+	if len(files) == 0 {
+		return func() {}
+	}
+
+	if err := target.Run(ctx, runtime.Process{Command: "mkdir -p " + logTailPidDir, Output: output}); err != nil {
+		log.Warnf("Unable to follow log files: %v", err)
+		return func() {}
+	}
+
+	width := 0
+	for _, file := range files {
+		if len(file) > width {
+			width = len(file)
+		}
+	}
+	colored := isTerminal(output)
+
+	var wg sync.WaitGroup
+	for i, file := range files {
+		w := plumbing.NewPrefixWriter(output, outputPrefix(file, width, len(p.Manifest.Exec.Processes)+i, colored), outputLock)
+		proc := runtime.Process{
+			Command:   fmt.Sprintf("echo $$ > %s && exec tail -n 0 -F %s", logTailPidFile(i), shellQuote(file)),
+			Directory: workDir,
+			Output:    w,
+		}
+
+		log.Infof("Following log file %s", file)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			target.Run(ctx, proc)
+			w.Flush()
+		}()
+	}
+
+	return func() {
+		for i := range files {
+			cmd := fmt.Sprintf("kill $(cat %s) 2>/dev/null; true", logTailPidFile(i))
+			target.Run(context.Background(), runtime.Process{Command: cmd, Output: ioutil.Discard})
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(logTailStopTimeout):
+			log.Warnf("Log files are still being followed after %s, giving up on them", logTailStopTimeout)
+		}
+	}
+}
+
+// LogsDir returns the directory the exec phase's log files are saved into.
+func (p Package) LogsDir() string {
+	return filepath.Join(p.BuildRoot(), "logs", p.Name)
+}
+
+// saveLogFiles copies the exec phase's log files out of target into
+// LogsDir, masking any secrets in them.
+func (p Package) saveLogFiles(ctx context.Context, target runtime.Target, workDir string) error {
+	files := p.Manifest.Exec.LogFiles
+	if len(files) == 0 {
+		return nil
+	}
+
+	logsDir := p.LogsDir()
+	if err := os.MkdirAll(logsDir, 0700); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		dst := filepath.Join(logsDir, targetKey(file))
+		f, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		w := redact.NewWriter(f)
+		err = target.Run(ctx, runtime.Process{
+			Command:   "cat " + shellQuote(file),
+			Directory: workDir,
+			Output:    w,
+		})
+		w.Flush()
+		f.Close()
+		if err != nil {
+			log.Warnf("Unable to save log file %s: %v", file, err)
+			os.Remove(dst)
+			continue
+		}
+		log.Infof("Saved log file %s to %s", file, dst)
+	}
+
+	return nil
+}
+
+func logTailPidFile(i int) string {
+	return fmt.Sprintf("%s/%d.pid", logTailPidDir, i)
+}
+
+// shellQuote quotes s for use as a single word in a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
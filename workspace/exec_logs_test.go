@@ -0,0 +1,74 @@
+package workspace
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yourbase/yb/plumbing/redact"
+	"github.com/yourbase/yb/runtime"
+)
+
+// fakeCatTarget serves cat commands from a map of file contents.
+type fakeCatTarget struct {
+	runtime.Target
+
+	files map[string]string
+}
+
+func (t fakeCatTarget) Run(ctx context.Context, p runtime.Process) error {
+	for name, content := range t.files {
+		if p.Command == "cat "+shellQuote(name) {
+			p.Output.Write([]byte(content))
+			return nil
+		}
+	}
+	return &runtime.TargetRunError{ExitCode: 1, Message: "exit status 1"}
+}
+
+func TestSaveLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	redact.Add("hunter2")
+	defer redact.Reset()
+
+	pkg := Package{
+		Name:      "pkg",
+		Workspace: &Workspace{Path: dir},
+		Manifest: BuildManifest{Exec: ExecPhase{
+			LogFiles: []string{"log/app.log", "log/missing.log"},
+		}},
+	}
+	target := fakeCatTarget{files: map[string]string{"log/app.log": "password is hunter2\n"}}
+
+	if err := pkg.saveLogFiles(context.Background(), target, "/workspace"); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := ioutil.ReadFile(filepath.Join(pkg.LogsDir(), "log_app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(saved); got != "password is ***\n" {
+		t.Errorf("saved log = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(pkg.LogsDir(), "log_missing.log")); !os.IsNotExist(err) {
+		t.Errorf("missing log file was saved: %v", err)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got, want := shellQuote("it's here.log"), `'it'\''s here.log'`; got != want {
+		t.Errorf("shellQuote = %s, want %s", got, want)
+	}
+	if strings.Contains(shellQuote("$(rm -rf /)"), "\"") {
+		t.Error("shellQuote used double quotes")
+	}
+}
@@ -0,0 +1,171 @@
+package workspace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/yourbase/yb/plumbing"
+	"github.com/yourbase/yb/plumbing/log"
+	"github.com/yourbase/yb/runtime"
+)
+
+// Processes write their PID into this directory in the exec container, so
+// that they can be stopped when another one exits.
+const processPidDir = "/tmp/yb-processes"
+
+// The exec command running in the exec container writes its PID into this
+// file, so that it can be stopped along with everything it started.
+const execCommandPidFile = "/tmp/yb-exec-command.pid"
+
+// How long processes get to exit after being asked to, before they're killed
+const processStopTimeout = 10 * time.Second
+
+// ANSI colors the names of processes cycle through
+var processColors = []int{36, 33, 32, 35, 34, 31}
+
+type processExit struct {
+	name string
+	err  error
+}
+
+// runProcesses starts every process of the exec phase concurrently in target
+// and waits for one of them to exit. The others are then stopped, and the
+// exit status of the first one is returned: a *runtime.TargetRunError if it
+// failed with an exit code.
+func (p Package) runProcesses(ctx context.Context, target runtime.Target, workDir string, env []string, output io.Writer, outputLock *sync.Mutex) error {
+	processes := p.Manifest.Exec.Processes
+
+	names := make([]string, 0, len(processes))
+	width := 0
+	for name := range processes {
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	sort.Strings(names)
+
+	if err := target.Run(ctx, runtime.Process{Command: "mkdir -p " + processPidDir, Output: output}); err != nil {
+		return fmt.Errorf("Unable to create %s: %v", processPidDir, err)
+	}
+
+	colored := isTerminal(output)
+	exits := make(chan processExit, len(names))
+
+	for i, name := range names {
+		w := plumbing.NewPrefixWriter(output, outputPrefix(name, width, i, colored), outputLock)
+
+		// exec keeps the PID, so the process itself can be signalled
+		proc := runtime.Process{
+			Command:     fmt.Sprintf("echo $$ > %s && exec %s", processPidFile(name), processes[name]),
+			Directory:   workDir,
+			Output:      w,
+			Environment: append([]string{}, env...),
+		}
+
+		log.Infof("Starting process %s: %s", name, processes[name])
+		go func(name string) {
+			err := target.Run(ctx, proc)
+			w.Flush()
+			exits <- processExit{name: name, err: err}
+		}(name)
+	}
+
+	var first processExit
+	select {
+	case first = <-exits:
+		log.Infof("Process %s exited, stopping the others", first.name)
+	case <-ctx.Done():
+		first = processExit{err: ctx.Err()}
+		log.Infof("Stopping processes")
+	}
+
+	running := len(names)
+	if first.name != "" {
+		running--
+	}
+	p.stopProcesses(target, names, first.name, exits, running)
+
+	switch err := first.err.(type) {
+	case nil:
+		return nil
+	case *runtime.TargetRunError:
+		return &runtime.TargetRunError{
+			ExitCode: err.ExitCode,
+			Message:  fmt.Sprintf("Process %s exited with status %d", first.name, err.ExitCode),
+		}
+	default:
+		if first.name == "" {
+			return err
+		}
+		return fmt.Errorf("Process %s failed: %v", first.name, err)
+	}
+}
+
+// stopProcesses sends SIGTERM to all processes but the one that already
+// exited and waits for the remaining ones to exit, killing them if they
+// take too long.
+func (p Package) stopProcesses(target runtime.Target, names []string, exited string, exits <-chan processExit, running int) {
+	// The context of the processes may be gone already
+	ctx := context.Background()
+
+	signal := func(sig string) {
+		for _, name := range names {
+			if name == exited {
+				continue
+			}
+			cmd := fmt.Sprintf("kill -%s $(cat %s) 2>/dev/null; true", sig, processPidFile(name))
+			if err := target.Run(ctx, runtime.Process{Command: cmd, Output: ioutil.Discard}); err != nil {
+				log.Warnf("Unable to stop process %s: %v", name, err)
+			}
+		}
+	}
+
+	signal("TERM")
+	timeout := time.After(processStopTimeout)
+	for running > 0 {
+		select {
+		case <-exits:
+			running--
+		case <-timeout:
+			log.Warnf("Processes didn't stop within %s, killing them", processStopTimeout)
+			signal("KILL")
+			timeout = nil
+		}
+	}
+}
+
+// outputPrefix returns the prefix for lines of output from name, padded to
+// width and colored by index if colored is set.
+func outputPrefix(name string, width int, index int, colored bool) string {
+	prefix := fmt.Sprintf("%-*s | ", width, name)
+	if colored {
+		prefix = fmt.Sprintf("\x1b[%dm%s\x1b[0m", processColors[index%len(processColors)], prefix)
+	}
+	return prefix
+}
+
+// execCommand wraps an exec command so that it runs in a process group of its
+// own, led by the process whose PID goes into execCommandPidFile. The command
+// exits with the command's status.
+func execCommand(command string) string {
+	return fmt.Sprintf("set -m; bash -c %s & echo $! > %s; wait $!; status=$?; rm -f %s; exit $status",
+		shellQuote(command), execCommandPidFile, execCommandPidFile)
+}
+
+func processPidFile(name string) string {
+	return fmt.Sprintf("%s/%s.pid", processPidDir, targetKey(name))
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && terminal.IsTerminal(int(f.Fd()))
+}
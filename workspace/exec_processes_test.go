@@ -0,0 +1,80 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/yourbase/yb/runtime"
+)
+
+// fakeProcessTarget fails processes running "exit 3" right away and blocks
+// every other one until it is sent SIGTERM.
+type fakeProcessTarget struct {
+	runtime.Target
+
+	mu      sync.Mutex
+	running map[string]chan struct{}
+	killed  []string
+}
+
+func (t *fakeProcessTarget) Run(ctx context.Context, p runtime.Process) error {
+	switch {
+	case strings.HasPrefix(p.Command, "mkdir"):
+		return nil
+	case strings.HasPrefix(p.Command, "kill"):
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		name := strings.TrimSuffix(strings.TrimPrefix(p.Command, "kill -TERM $(cat "+processPidDir+"/"), ".pid) 2>/dev/null; true")
+		t.killed = append(t.killed, name)
+		if ch, ok := t.running[name]; ok {
+			close(ch)
+		}
+		return nil
+	}
+
+	command := p.Command[strings.Index(p.Command, "exec ")+len("exec "):]
+	p.Output.Write([]byte("started " + command + "\n"))
+	if command == "exit 3" {
+		return &runtime.TargetRunError{ExitCode: 3, Message: "exit status 3"}
+	}
+
+	name := strings.TrimSuffix(strings.TrimPrefix(p.Command, "echo $$ > "+processPidDir+"/"), ".pid && exec "+command)
+	ch := make(chan struct{})
+	t.mu.Lock()
+	for _, killed := range t.killed {
+		if killed == name {
+			close(ch)
+		}
+	}
+	t.running[name] = ch
+	t.mu.Unlock()
+	<-ch
+	return nil
+}
+
+func TestRunProcesses(t *testing.T) {
+	pkg := Package{Manifest: BuildManifest{Exec: ExecPhase{
+		Processes: map[string]string{
+			"web":    "serve",
+			"worker": "exit 3",
+		},
+	}}}
+	target := &fakeProcessTarget{running: make(map[string]chan struct{})}
+
+	var output bytes.Buffer
+	err := pkg.runProcesses(context.Background(), target, "/workspace", nil, &output, new(sync.Mutex))
+
+	runErr, ok := err.(*runtime.TargetRunError)
+	if !ok || runErr.ExitCode != 3 {
+		t.Fatalf("runProcesses error = %v, want exit status 3", err)
+	}
+	if len(target.killed) != 1 || target.killed[0] != "web" {
+		t.Errorf("stopped processes = %v, want [web]", target.killed)
+	}
+	if !strings.Contains(output.String(), "worker | started exit 3\n") {
+		t.Errorf("output isn't prefixed with the process name:\n%s", output.String())
+	}
+}
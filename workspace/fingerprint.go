@@ -0,0 +1,170 @@
+package workspace
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fingerprint returns a digest of everything that goes into building the
+// target: its definition, the tools it installs, the flags it is built with,
+// the contents of every file matched by its inputs, resolved relative to
+// rootDir, the artifacts of the targets of other packages it builds after,
+// and the fingerprints of the targets of its own package it builds after, as
+// set by Package.targetFingerprint.
+func (bt BuildTarget) fingerprint(rootDir string, tools []string, flags BuildFlags) (string, error) {
+	h := sha256.New()
+
+	definition := struct {
+		Target      BuildTarget
+		Tools       []string
+		HostOnly    bool
+		ExecPrefix  string
+		Environment string
+		EnvFileEnv  []string
+	}{
+		Target:      bt,
+		Tools:       tools,
+		HostOnly:    bt.HostOnly || flags.HostOnly,
+		ExecPrefix:  flags.ExecPrefix,
+		Environment: flags.Environment,
+		EnvFileEnv:  bt.envFileEnv,
+	}
+	if err := json.NewEncoder(h).Encode(definition); err != nil {
+		return "", err
+	}
+
+	files := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, pattern := range bt.Inputs {
+		matches, err := expandGlob(rootDir, pattern)
+		if err != nil {
+			return "", fmt.Errorf("Invalid input pattern '%s': %v", pattern, err)
+		}
+		for _, match := range matches {
+			err := filepath.Walk(filepath.Join(rootDir, match), func(p string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(rootDir, p)
+				if err != nil {
+					return err
+				}
+				if !seen[rel] {
+					seen[rel] = true
+					files = append(files, rel)
+				}
+				return nil
+			})
+			if err != nil {
+				return "", fmt.Errorf("Unable to read input '%s': %v", match, err)
+			}
+		}
+	}
+	sort.Strings(files)
+
+	for _, rel := range files {
+		f, err := os.Open(filepath.Join(rootDir, rel))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", filepath.ToSlash(rel))
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("Unable to read input '%s': %v", rel, err)
+		}
+		h.Write([]byte{0})
+	}
+
+	// The artifact manifests of upstream targets hold the digest of every
+	// artifact, so they stand in for the artifacts themselves. A target that
+	// wasn't built yet has none.
+	for _, a := range bt.upstreamArtifacts {
+		data, err := ioutil.ReadFile(filepath.Join(a.HostDir, ArtifactManifestFile))
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("Unable to read the artifacts of %s: %v", a.Ref, err)
+		}
+		fmt.Fprintf(h, "%s\x00", a.Ref)
+		h.Write(data)
+		h.Write([]byte{0})
+	}
+
+	for _, fp := range bt.dependencyFingerprints {
+		fmt.Fprintf(h, "%s\x00", fp)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// targetFingerprint returns the fingerprint of a prepared target, including
+// the fingerprints of every target of the package it builds after, directly
+// or not. The fingerprint is empty if one of those doesn't declare its
+// inputs: it is built every time, so the target can't tell whether anything
+// it uses changed.
+func (p Package) targetFingerprint(tgt BuildTarget, rootDir string, tools []string, flags BuildFlags) (string, error) {
+	names := make([]string, 0, len(tgt.BuildAfter))
+	for _, name := range tgt.BuildAfter {
+		if !isPackageRef(name) {
+			names = append(names, name)
+		}
+	}
+	deps, err := p.Manifest.ResolveBuildTargets(names...)
+	if err != nil {
+		return "", err
+	}
+
+	tgt.dependencyFingerprints = make([]string, 0, len(deps))
+	for _, dep := range deps {
+		if len(dep.Inputs) == 0 {
+			return "", nil
+		}
+		dep, depTools, depRootDir, err := p.prepareTarget(dep)
+		if err != nil {
+			return "", err
+		}
+		fp, err := dep.fingerprint(depRootDir, depTools, flags)
+		if err != nil {
+			return "", err
+		}
+		tgt.dependencyFingerprints = append(tgt.dependencyFingerprints, dep.Name+"="+fp)
+	}
+
+	return tgt.fingerprint(rootDir, tools, flags)
+}
+
+func (p Package) fingerprintFile(targetName string) string {
+	return filepath.Join(p.BuildRoot(), "fingerprints", p.Name, targetKey(targetName))
+}
+
+// targetUpToDate reports whether the last successful build of the target had
+// the same fingerprint and all of its declared outputs are still around.
+func (p Package) targetUpToDate(tgt BuildTarget, rootDir string, fingerprint string) bool {
+	recorded, err := ioutil.ReadFile(p.fingerprintFile(tgt.Name))
+	if err != nil || strings.TrimSpace(string(recorded)) != fingerprint {
+		return false
+	}
+
+	for _, pattern := range tgt.Outputs {
+		matches, err := expandGlob(rootDir, pattern)
+		if err != nil || len(matches) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p Package) recordFingerprint(tgt BuildTarget, fingerprint string) error {
+	file := p.fingerprintFile(tgt.Name)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(fingerprint+"\n"), 0644)
+}
@@ -0,0 +1,153 @@
+package workspace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkgDir := filepath.Join(dir, "pkg")
+	writeFile := func(name, contents string) {
+		t.Helper()
+		p := filepath.Join(pkgDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("src/main.go", "package main")
+	writeFile("README.md", "docs")
+
+	tgt := BuildTarget{
+		Name:     "default",
+		Commands: []string{"go build -o bin/app ./src"},
+		Inputs:   []string{"src/**/*.go"},
+		Outputs:  []string{"bin/app"},
+	}
+	tools := []string{"go:1.14.4"}
+
+	first, err := tgt.fingerprint(pkgDir, tools, BuildFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile("README.md", "more docs")
+	if fp, _ := tgt.fingerprint(pkgDir, tools, BuildFlags{}); fp != first {
+		t.Error("fingerprint changed when a file that isn't an input changed")
+	}
+
+	if fp, _ := tgt.fingerprint(pkgDir, []string{"go:1.15"}, BuildFlags{}); fp == first {
+		t.Error("fingerprint didn't change with the tools")
+	}
+
+	changed := tgt
+	changed.Commands = []string{"go build -race -o bin/app ./src"}
+	if fp, _ := changed.fingerprint(pkgDir, tools, BuildFlags{}); fp == first {
+		t.Error("fingerprint didn't change with the commands")
+	}
+
+	pkg := Package{Name: "pkg", path: pkgDir, Workspace: &Workspace{Path: dir}}
+	if err := pkg.recordFingerprint(tgt, first); err != nil {
+		t.Fatal(err)
+	}
+	if pkg.targetUpToDate(tgt, pkgDir, first) {
+		t.Error("target is up to date without its outputs")
+	}
+	writeFile("bin/app", "binary")
+	if !pkg.targetUpToDate(tgt, pkgDir, first) {
+		t.Error("target isn't up to date with the recorded fingerprint")
+	}
+
+	writeFile("src/main.go", "package main // changed")
+	second, err := tgt.fingerprint(pkgDir, tools, BuildFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Error("fingerprint didn't change with an input")
+	}
+	if pkg.targetUpToDate(tgt, pkgDir, second) {
+		t.Error("target is up to date after an input changed")
+	}
+
+	// Targets of the package it builds after go into it too
+	gen := BuildTarget{Name: "gen", Commands: []string{"protoc api.proto"}, Inputs: []string{"proto/*.proto"}}
+	app := tgt
+	app.BuildAfter = []string{"gen"}
+	pkg.Manifest = BuildManifest{BuildTargets: []BuildTarget{gen, app}}
+	writeFile("proto/api.proto", "message A {}")
+	before, err := pkg.targetFingerprint(app, pkgDir, tools, BuildFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == second {
+		t.Error("fingerprint didn't change with a target it builds after")
+	}
+	writeFile("proto/api.proto", "message B {}")
+	if fp, _ := pkg.targetFingerprint(app, pkgDir, tools, BuildFlags{}); fp == before {
+		t.Error("fingerprint didn't change with an input of a target it builds after")
+	}
+
+	gen.Inputs = nil
+	pkg.Manifest = BuildManifest{BuildTargets: []BuildTarget{gen, app}}
+	if fp, err := pkg.targetFingerprint(app, pkgDir, tools, BuildFlags{}); err != nil || fp != "" {
+		t.Errorf("targetFingerprint() = %q, %v after a target without inputs, want no fingerprint", fp, err)
+	}
+}
+
+func TestFingerprintUpstreamArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstreamDir := filepath.Join(dir, "output", "protos", "default")
+	tgt := BuildTarget{
+		Name:              "default",
+		Commands:          []string{"go build ./..."},
+		upstreamArtifacts: []upstreamArtifact{{Ref: "@protos", HostDir: upstreamDir}},
+	}
+
+	unbuilt, err := tgt.fingerprint(dir, nil, BuildFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(upstreamDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeManifest := func(digest string) string {
+		t.Helper()
+		manifest := `{"target":"default","artifacts":[{"path":"api.pb.go","size":1,"sha256":"` + digest + `"}]}`
+		if err := ioutil.WriteFile(filepath.Join(upstreamDir, ArtifactManifestFile), []byte(manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fp, err := tgt.fingerprint(dir, nil, BuildFlags{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+
+	first := writeManifest("aaaa")
+	if first == unbuilt {
+		t.Error("fingerprint didn't change when the upstream target was built")
+	}
+	if fp := writeManifest("aaaa"); fp != first {
+		t.Error("fingerprint changed when the upstream artifacts didn't")
+	}
+	if fp := writeManifest("bbbb"); fp == first {
+		t.Error("fingerprint didn't change with the upstream artifacts")
+	}
+}
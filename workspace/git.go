@@ -0,0 +1,476 @@
+package workspace
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/yaml.v2"
+
+	. "github.com/yourbase/yb/plumbing"
+	"github.com/yourbase/yb/plumbing/log"
+)
+
+// File in the workspace root recording the commit of every repository
+const LockFileName = "workspace.lock"
+
+// Remote repositories are fetched from when their branch doesn't track one
+const defaultRemote = "origin"
+
+// Repository is a git checkout in a workspace holding some of its packages.
+// Packages in subdirectories of the same checkout, like the packages of a
+// monorepo, share it.
+type Repository struct {
+	// Path of the checkout relative to the workspace, slash-separated
+	Name string
+	// Absolute path of the checkout
+	Path string
+	// Names of the workspace's packages in the checkout, sorted
+	Packages []string
+}
+
+// RepositoryStatus describes the git checkout of a repository.
+type RepositoryStatus struct {
+	// Branch checked out, empty if HEAD is detached
+	Branch string
+	Commit string
+	// Remote-tracking branch the branch follows, like origin/master, if any
+	Upstream string
+	// Whether there are uncommitted changes
+	Dirty bool
+	// Commits on the branch that aren't upstream yet, and the other way around
+	Ahead  int
+	Behind int
+}
+
+// LockedRepository is the entry of a repository in the workspace's lock
+// file.
+type LockedRepository struct {
+	Remote string `yaml:"remote,omitempty"`
+	Branch string `yaml:"branch,omitempty"`
+	Commit string `yaml:"commit"`
+}
+
+// WorkspaceLock records the commit every repository of a workspace is at,
+// by the repository's name, so the same checkouts can be restored elsewhere.
+type WorkspaceLock struct {
+	Repositories map[string]LockedRepository `yaml:"repositories"`
+}
+
+// Repositories returns the git checkouts holding the packages of the
+// workspace, sorted by name. A package's checkout may be in a directory
+// above it.
+func (w Workspace) Repositories() ([]Repository, error) {
+	byPath := make(map[string]*Repository)
+	for _, pkg := range w.packages {
+		repo, err := git.PlainOpenWithOptions(pkg.Path(), &git.PlainOpenOptions{DetectDotGit: true})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open the git repository of %s: %v", pkg.Name, err)
+		}
+		wt, err := repo.Worktree()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open the git repository of %s: %v", pkg.Name, err)
+		}
+
+		root := wt.Filesystem.Root()
+		r, ok := byPath[root]
+		if !ok {
+			name, err := filepath.Rel(w.Path, root)
+			if err != nil {
+				return nil, err
+			}
+			r = &Repository{Name: filepath.ToSlash(name), Path: root}
+			byPath[root] = r
+		}
+		r.Packages = append(r.Packages, pkg.Name)
+	}
+
+	result := make([]Repository, 0, len(byPath))
+	for _, r := range byPath {
+		sort.Strings(r.Packages)
+		result = append(result, *r)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// Repository returns the repository of the workspace with the given name,
+// which doesn't have to be checked out yet.
+func (w Workspace) Repository(name string) Repository {
+	return Repository{Name: name, Path: filepath.Join(w.Path, filepath.FromSlash(name))}
+}
+
+// open opens the repository's checkout.
+func (r Repository) open() (*git.Repository, error) {
+	repo, err := git.PlainOpen(r.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open the git repository %s: %v", r.Name, err)
+	}
+	return repo, nil
+}
+
+// trackingBranch returns the remote and the branch on it that a local branch
+// follows. Branches without that configured follow the branch of the same
+// name on origin.
+func trackingBranch(repo *git.Repository, branch string) (string, plumbing.ReferenceName) {
+	cfg, err := repo.Branch(branch)
+	if err == nil && cfg.Remote != "" && cfg.Merge != "" {
+		return cfg.Remote, cfg.Merge
+	}
+	return defaultRemote, plumbing.NewBranchReferenceName(branch)
+}
+
+// isDirty reports whether the work tree of repo has uncommitted changes.
+func isDirty(repo *git.Repository) (bool, error) {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return false, err
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return false, err
+	}
+	return !status.IsClean(), nil
+}
+
+// GitStatus describes the repository's checkout. The ahead and behind counts
+// are relative to what was last fetched from the upstream branch.
+func (r Repository) GitStatus() (RepositoryStatus, error) {
+	var status RepositoryStatus
+	repo, err := r.open()
+	if err != nil {
+		return status, err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return status, fmt.Errorf("Unable to find HEAD of %s: %v", r.Name, err)
+	}
+	status.Commit = head.Hash().String()
+
+	status.Dirty, err = isDirty(repo)
+	if err != nil {
+		return status, fmt.Errorf("Unable to get the status of %s: %v", r.Name, err)
+	}
+
+	if !head.Name().IsBranch() {
+		return status, nil
+	}
+	status.Branch = head.Name().Short()
+
+	remote, merge := trackingBranch(repo, status.Branch)
+	upstream, err := repo.Reference(plumbing.NewRemoteReferenceName(remote, merge.Short()), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return status, nil
+	}
+	if err != nil {
+		return status, fmt.Errorf("Unable to find the upstream branch of %s: %v", r.Name, err)
+	}
+	status.Upstream = fmt.Sprintf("%s/%s", remote, merge.Short())
+
+	status.Ahead, status.Behind, err = aheadBehind(repo, head.Hash(), upstream.Hash())
+	if err != nil {
+		return status, fmt.Errorf("Unable to compare %s with %s: %v", r.Name, status.Upstream, err)
+	}
+	return status, nil
+}
+
+// aheadBehind counts the commits reachable from local but not from upstream,
+// and the other way around. History before their merge bases isn't walked.
+func aheadBehind(repo *git.Repository, local, upstream plumbing.Hash) (int, int, error) {
+	if local == upstream {
+		return 0, 0, nil
+	}
+	localCommit, err := repo.CommitObject(local)
+	if err != nil {
+		return 0, 0, err
+	}
+	upstreamCommit, err := repo.CommitObject(upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+	bases, err := localCommit.MergeBase(upstreamCommit)
+	if err != nil {
+		return 0, 0, err
+	}
+	ignore := make([]plumbing.Hash, 0, len(bases))
+	for _, base := range bases {
+		ignore = append(ignore, base.Hash)
+	}
+
+	reachable := func(c *object.Commit) (map[plumbing.Hash]bool, error) {
+		result := make(map[plumbing.Hash]bool)
+		err := object.NewCommitPreorderIter(c, nil, ignore).ForEach(func(c *object.Commit) error {
+			result[c.Hash] = true
+			return nil
+		})
+		return result, err
+	}
+	fromLocal, err := reachable(localCommit)
+	if err != nil {
+		return 0, 0, err
+	}
+	fromUpstream, err := reachable(upstreamCommit)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ahead, behind := 0, 0
+	for h := range fromLocal {
+		if !fromUpstream[h] {
+			ahead++
+		}
+	}
+	for h := range fromUpstream {
+		if !fromLocal[h] {
+			behind++
+		}
+	}
+	return ahead, behind, nil
+}
+
+// Sync fetches the upstream branch of the repository and fast-forwards the
+// checked out branch to it. It refuses to touch checkouts with uncommitted
+// changes, a detached HEAD or a branch that has diverged. It reports whether
+// the branch moved.
+func (r Repository) Sync(ctx context.Context) (bool, error) {
+	repo, err := r.open()
+	if err != nil {
+		return false, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return false, fmt.Errorf("Unable to find HEAD of %s: %v", r.Name, err)
+	}
+	if !head.Name().IsBranch() {
+		return false, fmt.Errorf("%s isn't on a branch", r.Name)
+	}
+	if dirty, err := isDirty(repo); err != nil {
+		return false, fmt.Errorf("Unable to get the status of %s: %v", r.Name, err)
+	} else if dirty {
+		return false, fmt.Errorf("%s has uncommitted changes", r.Name)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return false, err
+	}
+	remote, merge := trackingBranch(repo, head.Name().Short())
+	auth, err := remoteAuth(repo, remote)
+	if err != nil {
+		return false, fmt.Errorf("Unable to sync %s: %v", r.Name, err)
+	}
+	err = wt.PullContext(ctx, &git.PullOptions{
+		RemoteName:    remote,
+		ReferenceName: merge,
+		Auth:          auth,
+	})
+	ReportGitAuth(auth, err)
+	switch err {
+	case nil:
+		return true, nil
+	case git.NoErrAlreadyUpToDate:
+		return false, nil
+	case git.ErrNonFastForwardUpdate:
+		return false, fmt.Errorf("%s has diverged from %s/%s and can't be fast-forwarded", r.Name, remote, merge.Short())
+	default:
+		return false, fmt.Errorf("Unable to sync %s with %s/%s: %v", r.Name, remote, merge.Short(), err)
+	}
+}
+
+// Locked returns the lock file entry for the repository's current checkout.
+func (r Repository) Locked() (LockedRepository, error) {
+	repo, err := r.open()
+	if err != nil {
+		return LockedRepository{}, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return LockedRepository{}, fmt.Errorf("Unable to find HEAD of %s: %v", r.Name, err)
+	}
+
+	locked := LockedRepository{Commit: head.Hash().String()}
+	remoteName := defaultRemote
+	if head.Name().IsBranch() {
+		locked.Branch = head.Name().Short()
+		remoteName, _ = trackingBranch(repo, locked.Branch)
+	}
+	if remote, err := repo.Remote(remoteName); err == nil && len(remote.Config().URLs) > 0 {
+		locked.Remote = remote.Config().URLs[0]
+	}
+	return locked, nil
+}
+
+// Restore checks out the commit recorded for the repository, fetching it
+// first if it isn't there yet. A repository that isn't checked out at all is
+// cloned from the recorded remote. HEAD is left detached at the commit.
+func (r Repository) Restore(ctx context.Context, locked LockedRepository) error {
+	if _, err := os.Stat(r.Path); os.IsNotExist(err) {
+		return r.clone(ctx, locked)
+	}
+
+	repo, err := r.open()
+	if err != nil {
+		return err
+	}
+	if dirty, err := isDirty(repo); err != nil {
+		return fmt.Errorf("Unable to get the status of %s: %v", r.Name, err)
+	} else if dirty {
+		return fmt.Errorf("%s has uncommitted changes", r.Name)
+	}
+	return r.checkout(ctx, repo, locked)
+}
+
+// clone clones the repository from the recorded remote into its path and
+// checks out the recorded commit.
+func (r Repository) clone(ctx context.Context, locked LockedRepository) error {
+	if locked.Remote == "" {
+		return fmt.Errorf("%s isn't checked out and has no remote to clone it from", r.Name)
+	}
+	auth, err := GitAuth(locked.Remote)
+	if err != nil {
+		return fmt.Errorf("Unable to clone %s: %v", r.Name, err)
+	}
+
+	log.Infof("Cloning %s from %s", r.Name, locked.Remote)
+	repo, err := git.PlainCloneContext(ctx, r.Path, false, &git.CloneOptions{URL: locked.Remote, Auth: auth})
+	ReportGitAuth(auth, err)
+	if err != nil {
+		os.RemoveAll(r.Path)
+		return fmt.Errorf("Unable to clone %s from %s: %v", r.Name, locked.Remote, err)
+	}
+	return r.checkout(ctx, repo, locked)
+}
+
+// checkout checks out the recorded commit in repo, fetching it from the
+// remote with the recorded URL if it isn't there.
+func (r Repository) checkout(ctx context.Context, repo *git.Repository, locked LockedRepository) error {
+	hash := plumbing.NewHash(locked.Commit)
+	if _, err := repo.CommitObject(hash); err != nil {
+		remoteName := remoteWithURL(repo, locked.Remote)
+		log.Infof("Fetching %s from %s", r.Name, remoteName)
+		auth, err := remoteAuth(repo, remoteName)
+		if err != nil {
+			return fmt.Errorf("Unable to fetch %s: %v", r.Name, err)
+		}
+		err = repo.FetchContext(ctx, &git.FetchOptions{RemoteName: remoteName, Tags: git.AllTags, Auth: auth})
+		ReportGitAuth(auth, err)
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return fmt.Errorf("Unable to fetch %s: %v", r.Name, err)
+		}
+		if _, err := repo.CommitObject(hash); err != nil {
+			return fmt.Errorf("Commit %s of %s not found in %s", locked.Commit, r.Name, remoteName)
+		}
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Hash: hash}); err != nil {
+		return fmt.Errorf("Unable to check out %s of %s: %v", locked.Commit, r.Name, err)
+	}
+	return nil
+}
+
+// remoteAuth returns how to authenticate with the named remote of repo.
+func remoteAuth(repo *git.Repository, name string) (transport.AuthMethod, error) {
+	remote, err := repo.Remote(name)
+	if err != nil {
+		return nil, err
+	}
+	if urls := remote.Config().URLs; len(urls) > 0 {
+		return GitAuth(urls[0])
+	}
+	return nil, nil
+}
+
+// remoteWithURL returns the name of the remote of repo fetching from url,
+// falling back to origin.
+func remoteWithURL(repo *git.Repository, url string) string {
+	remotes, err := repo.Remotes()
+	if err != nil || url == "" {
+		return defaultRemote
+	}
+	for _, remote := range remotes {
+		for _, u := range remote.Config().URLs {
+			if u == url {
+				return remote.Config().Name
+			}
+		}
+	}
+	return defaultRemote
+}
+
+// LockFile returns the path to the workspace's lock file.
+func (w Workspace) LockFile() string {
+	return filepath.Join(w.Path, LockFileName)
+}
+
+// Lock records the commit every repository in the workspace is at.
+func (w Workspace) Lock() (WorkspaceLock, error) {
+	repos, err := w.Repositories()
+	if err != nil {
+		return WorkspaceLock{}, err
+	}
+	lock := WorkspaceLock{Repositories: make(map[string]LockedRepository)}
+	for _, r := range repos {
+		locked, err := r.Locked()
+		if err != nil {
+			return WorkspaceLock{}, err
+		}
+		lock.Repositories[r.Name] = locked
+	}
+	return lock, nil
+}
+
+// SaveLock writes lock to the workspace's lock file.
+func (w Workspace) SaveLock(lock WorkspaceLock) error {
+	data, err := yaml.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	header := "# Commits of the repositories in this workspace, restored by `yb workspace sync -locked`\n"
+	if err := ioutil.WriteFile(w.LockFile(), append([]byte(header), data...), 0644); err != nil {
+		return fmt.Errorf("Unable to write %s: %v", w.LockFile(), err)
+	}
+	return nil
+}
+
+// ReadLock reads the workspace's lock file.
+func (w Workspace) ReadLock() (WorkspaceLock, error) {
+	var lock WorkspaceLock
+	data, err := ioutil.ReadFile(w.LockFile())
+	if err != nil {
+		return lock, fmt.Errorf("Unable to read the workspace lock file: %v", err)
+	}
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		return lock, fmt.Errorf("Unable to parse %s: %v", w.LockFile(), err)
+	}
+	for name, locked := range lock.Repositories {
+		if locked.Commit == "" {
+			return lock, fmt.Errorf("No commit recorded for %s in %s", name, w.LockFile())
+		}
+	}
+	return lock, nil
+}
+
+// ReadWorkspaceLock reads the lock file of the workspace around the current
+// directory. Unlike LoadWorkspace it doesn't load the workspace's packages, so
+// it works in a workspace whose repositories aren't checked out yet.
+func ReadWorkspaceLock() (Workspace, WorkspaceLock, error) {
+	root, err := FindWorkspaceRoot()
+	if err != nil {
+		return Workspace{}, WorkspaceLock{}, fmt.Errorf("Unable to find the workspace: %v", err)
+	}
+	w := Workspace{Path: root}
+	lock, err := w.ReadLock()
+	return w, lock, err
+}
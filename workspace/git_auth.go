@@ -0,0 +1,336 @@
+package workspace
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+
+	. "github.com/yourbase/yb/plumbing"
+	"github.com/yourbase/yb/plumbing/log"
+)
+
+// Key files looked for in ~/.ssh, tried in order after the SSH agent's keys
+var sshKeyFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// GitAuth returns how to authenticate with the git remote at url. SSH remotes
+// use the key file YOURBASE_SSH_KEY points to, or else the SSH agent's keys
+// followed by the key files found in ~/.ssh. HTTPS remotes use
+// YOURBASE_GITHUB_TOKEN for github.com, or YOURBASE_GIT_USERNAME and
+// YOURBASE_GIT_PASSWORD for the host YOURBASE_GIT_HOST names, or else what git
+// credential helpers or .netrc have for the host. Credentials are never sent over plain HTTP. A nil method
+// means the remote is accessed anonymously.
+//
+// Pass the result of using the method to ReportGitAuth, so credential helpers
+// learn whether their credentials worked.
+func GitAuth(url string) (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid git remote %s: %v", url, err)
+	}
+
+	switch endpoint.Protocol {
+	case "ssh":
+		return sshAuth(endpoint)
+	case "https":
+		return httpAuth(endpoint), nil
+	case "http":
+		log.Debugf("Not sending credentials to %s over plain HTTP", endpoint.Host)
+		return nil, nil
+	default:
+		return nil, nil
+	}
+}
+
+func sshAuth(endpoint *transport.Endpoint) (transport.AuthMethod, error) {
+	username := endpoint.User
+	if username == "" {
+		username = ssh.DefaultUsername
+	}
+	passphrase := os.Getenv("YOURBASE_SSH_KEY_PASSPHRASE")
+
+	if keyFile, ok := os.LookupEnv("YOURBASE_SSH_KEY"); ok {
+		log.Debugf("Using SSH key %s for %s", keyFile, endpoint.Host)
+		auth, err := ssh.NewPublicKeysFromFile(username, keyFile, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to use SSH key %s: %v", keyFile, err)
+		}
+		return auth, nil
+	}
+
+	var agent *ssh.PublicKeysCallback
+	if _, ok := os.LookupEnv("SSH_AUTH_SOCK"); ok {
+		var err error
+		if agent, err = ssh.NewSSHAgentAuth(username); err != nil {
+			log.Debugf("Unable to use the SSH agent: %v", err)
+		}
+	}
+
+	home, err := homeDir()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]gossh.Signer, 0, len(sshKeyFiles))
+	for _, name := range sshKeyFiles {
+		f := filepath.Join(home, ".ssh", name)
+		if !PathExists(f) {
+			continue
+		}
+		key, err := ssh.NewPublicKeysFromFile(username, f, passphrase)
+		if err != nil {
+			log.Debugf("Unable to use SSH key %s: %v", f, err)
+			continue
+		}
+		keys = append(keys, key.Signer)
+	}
+
+	if agent == nil && len(keys) == 0 {
+		return nil, fmt.Errorf("No SSH agent running and no usable key found in %s", filepath.Join(home, ".ssh"))
+	}
+	log.Debugf("Using the SSH agent and %d key files for %s", len(keys), endpoint.Host)
+	return &ssh.PublicKeysCallback{
+		User:     username,
+		Callback: sshSigners(agent, keys),
+	}, nil
+}
+
+// sshSigners returns the keys of the agent, if there is one, followed by
+// keys. The server is offered each of them in turn, so keys that aren't in
+// the agent are still tried.
+func sshSigners(agent *ssh.PublicKeysCallback, keys []gossh.Signer) func() ([]gossh.Signer, error) {
+	return func() ([]gossh.Signer, error) {
+		signers := make([]gossh.Signer, 0, len(keys))
+		if agent != nil {
+			agentKeys, err := agent.Callback()
+			if err != nil {
+				log.Debugf("Unable to get keys from the SSH agent: %v", err)
+			}
+			signers = append(signers, agentKeys...)
+		}
+		return append(signers, keys...), nil
+	}
+}
+
+// helperAuth is basic auth with credentials from git credential helpers,
+// which want to hear whether they worked.
+type helperAuth struct {
+	*http.BasicAuth
+	// What the credentials were asked for with, in git credential's format
+	query string
+}
+
+func httpAuth(endpoint *transport.Endpoint) transport.AuthMethod {
+	if token, ok := os.LookupEnv("YOURBASE_GITHUB_TOKEN"); ok && endpoint.Host == "github.com" {
+		log.Debugf("Using GitHub token for %s", endpoint.Host)
+		return &http.BasicAuth{Username: "yourbase", Password: token}
+	}
+
+	username, hasUsername := os.LookupEnv("YOURBASE_GIT_USERNAME")
+	password, hasPassword := os.LookupEnv("YOURBASE_GIT_PASSWORD")
+	if hasUsername && hasPassword {
+		if host := os.Getenv("YOURBASE_GIT_HOST"); host != "" && strings.EqualFold(host, endpointHost(endpoint)) {
+			log.Debugf("Using YOURBASE_GIT_USERNAME and YOURBASE_GIT_PASSWORD for %s", endpoint.Host)
+			return &http.BasicAuth{Username: username, Password: password}
+		}
+		log.Debugf("Not sending YOURBASE_GIT_USERNAME and YOURBASE_GIT_PASSWORD to %s, YOURBASE_GIT_HOST doesn't name it", endpoint.Host)
+	}
+
+	query := credentialQuery(endpoint)
+	if username, password, ok := credentialFill(query, endpoint.User); ok {
+		log.Debugf("Using credentials from git credential helpers for %s", endpoint.Host)
+		return &helperAuth{
+			BasicAuth: &http.BasicAuth{Username: username, Password: password},
+			query:     query,
+		}
+	}
+
+	if username, password, ok := netrcCredentials(endpoint.Host); ok {
+		log.Debugf("Using credentials from .netrc for %s", endpoint.Host)
+		return &http.BasicAuth{Username: username, Password: password}
+	}
+
+	return nil
+}
+
+// ReportGitAuth tells git credential helpers whether the credentials GitAuth
+// got from them worked, given the error of the operation that used them. Like
+// git, working credentials are approved, so helpers may store them, and
+// rejected ones are erased. Other errors don't say anything about the
+// credentials, and other methods are left alone.
+func ReportGitAuth(auth transport.AuthMethod, err error) {
+	a, ok := auth.(*helperAuth)
+	if !ok {
+		return
+	}
+	action := ""
+	switch err {
+	case nil, git.NoErrAlreadyUpToDate:
+		action = "approve"
+	case transport.ErrAuthenticationRequired, transport.ErrAuthorizationFailed:
+		action = "reject"
+	default:
+		return
+	}
+
+	input := a.query + fmt.Sprintf("username=%s\npassword=%s\n\n", a.Username, a.Password)
+	if _, err := runCredential(action, input); err != nil {
+		log.Debugf("Unable to %s credentials with git credential helpers: %v", action, err)
+	}
+}
+
+// endpointHost returns the host of the endpoint, followed by its port if it
+// has one, like git.example.com:8443.
+func endpointHost(endpoint *transport.Endpoint) string {
+	if endpoint.Port != 0 {
+		return fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
+	}
+	return endpoint.Host
+}
+
+// credentialQuery describes the endpoint the way git credential reads it.
+func credentialQuery(endpoint *transport.Endpoint) string {
+	return fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\n", endpoint.Protocol, endpointHost(endpoint), strings.TrimPrefix(endpoint.Path, "/"))
+}
+
+// credentialFill asks the git credential helpers configured for the user for
+// a password for the query, and a username unless one is given, without ever
+// prompting for them.
+func credentialFill(query string, username string) (string, string, bool) {
+	input := query
+	if username != "" {
+		input += fmt.Sprintf("username=%s\n", username)
+	}
+	out, err := runCredential("fill", input+"\n")
+	if err != nil {
+		log.Debugf("No credentials from git credential helpers: %v", err)
+		return "", "", false
+	}
+
+	values := parseCredentialOutput(out)
+	if values["password"] == "" {
+		return "", "", false
+	}
+	return values["username"], values["password"], true
+}
+
+// runCredential runs git credential with the action, like fill or approve,
+// and input, never prompting the user.
+func runCredential(action string, input string) ([]byte, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("git", "credential", action)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=", "SSH_ASKPASS=")
+	return cmd.Output()
+}
+
+// parseCredentialOutput reads the key=value lines git credential prints.
+func parseCredentialOutput(data []byte) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+	return values
+}
+
+// netrcCredentials looks up the login and password for host in the file
+// NETRC points to, or else ~/.netrc.
+func netrcCredentials(host string) (string, string, bool) {
+	file := os.Getenv("NETRC")
+	if file == "" {
+		home, err := homeDir()
+		if err != nil {
+			return "", "", false
+		}
+		file = filepath.Join(home, ".netrc")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", "", false
+	}
+	return parseNetrc(data, host)
+}
+
+// parseNetrc finds the login and password for host in the contents of a
+// .netrc file, falling back to its default entry.
+func parseNetrc(data []byte, host string) (string, string, bool) {
+	type entry struct{ login, password string }
+	var (
+		found, fallback *entry
+		current         *entry
+	)
+
+	fields := strings.Fields(string(data))
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			current = nil
+			if i+1 < len(fields) {
+				i++
+				if fields[i] == host && found == nil {
+					found = &entry{}
+					current = found
+				}
+			}
+		case "default":
+			current = nil
+			if fallback == nil {
+				fallback = &entry{}
+				current = fallback
+			}
+		case "login", "password", "account":
+			if i+1 >= len(fields) {
+				break
+			}
+			i++
+			if current == nil {
+				continue
+			}
+			if fields[i-1] == "login" {
+				current.login = fields[i]
+			} else if fields[i-1] == "password" {
+				current.password = fields[i]
+			}
+		case "macdef":
+			// Macros run until an empty line, which Fields doesn't keep;
+			// they come last in practice, so stop here
+			current = nil
+			i = len(fields)
+		}
+	}
+
+	if found == nil {
+		found = fallback
+	}
+	if found == nil || found.password == "" {
+		return "", "", false
+	}
+	return found.login, found.password, true
+}
+
+func homeDir() (string, error) {
+	if home := os.Getenv("HOME"); home != "" {
+		return home, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("Unable to find the home directory: %v", err)
+	}
+	return u.HomeDir, nil
+}
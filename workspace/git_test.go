@@ -0,0 +1,187 @@
+package workspace
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// commitFile writes a file to the work tree of the repository in dir and
+// commits it.
+func commitFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add(name); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := wt.Commit("Change "+name, &git.CommitOptions{
+		Author: &object.Signature{Name: "yb", Email: "yb@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash.String()
+}
+
+func TestRepositoryGit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	upstreamDir := filepath.Join(dir, "upstream")
+	if _, err := git.PlainInit(upstreamDir, false); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, upstreamDir, "README", "one")
+
+	ws := testWorkspace(t, filepath.Join(dir, "ws"), map[string]BuildManifest{"api": {}})
+	pkg, _ := ws.PackageByName("api")
+	if _, err := git.PlainClone(pkg.Path(), false, &git.CloneOptions{URL: upstreamDir}); err != nil {
+		t.Fatal(err)
+	}
+	repos, err := ws.Repositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 1 || repos[0].Name != "api" {
+		t.Fatalf("Repositories() = %+v, want api", repos)
+	}
+	repo := repos[0]
+
+	second := commitFile(t, upstreamDir, "README", "two")
+	updated, err := repo.Sync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated {
+		t.Error("Sync didn't fast-forward")
+	}
+	status, err := repo.GitStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RepositoryStatus{Branch: "master", Commit: second, Upstream: "origin/master"}
+	if status != want {
+		t.Errorf("status after sync = %+v, want %+v", status, want)
+	}
+
+	lock, err := ws.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.SaveLock(lock); err != nil {
+		t.Fatal(err)
+	}
+
+	commitFile(t, pkg.Path(), "local", "change")
+	if err := ioutil.WriteFile(filepath.Join(pkg.Path(), "README"), []byte("dirty"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	status, err = repo.GitStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Ahead != 1 || status.Behind != 0 || !status.Dirty {
+		t.Errorf("status after local changes = %+v, want ahead 1 and dirty", status)
+	}
+	if _, err := repo.Sync(ctx); err == nil {
+		t.Error("Sync succeeded with uncommitted changes")
+	}
+
+	lock, err = ws.ReadLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.Repositories["api"].Commit != second || lock.Repositories["api"].Remote != upstreamDir {
+		t.Errorf("locked = %+v", lock.Repositories["api"])
+	}
+	if err := repo.Restore(ctx, lock.Repositories["api"]); err == nil {
+		t.Error("Restore succeeded with uncommitted changes")
+	}
+	if err := ioutil.WriteFile(filepath.Join(pkg.Path(), "README"), []byte("two"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Restore(ctx, lock.Repositories["api"]); err != nil {
+		t.Fatal(err)
+	}
+	status, err = repo.GitStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Commit != second || status.Branch != "" {
+		t.Errorf("status after restore = %+v, want detached at %s", status, second)
+	}
+
+	// A workspace without its checkouts gets them cloned
+	empty := Workspace{Path: filepath.Join(dir, "empty")}
+	if err := empty.Repository("api").Restore(ctx, lock.Repositories["api"]); err != nil {
+		t.Fatal(err)
+	}
+	status, err = empty.Repository("api").GitStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Commit != second {
+		t.Errorf("status after cloning = %+v, want %s", status, second)
+	}
+}
+
+func TestRepositoriesShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ws := testWorkspace(t, dir, map[string]BuildManifest{
+		"mono/api": {},
+		"mono/web": {},
+		"tools":    {},
+	})
+	for _, name := range []string{"mono", "tools"} {
+		if _, err := git.PlainInit(filepath.Join(dir, name), false); err != nil {
+			t.Fatal(err)
+		}
+		commitFile(t, filepath.Join(dir, name), "README", name)
+	}
+
+	repos, err := ws.Repositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Repository{
+		{Name: "mono", Path: filepath.Join(dir, "mono"), Packages: []string{"mono/api", "mono/web"}},
+		{Name: "tools", Path: filepath.Join(dir, "tools"), Packages: []string{"tools"}},
+	}
+	if !reflect.DeepEqual(repos, want) {
+		t.Errorf("Repositories() = %+v, want %+v", repos, want)
+	}
+
+	lock, err := ws.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lock.Repositories) != 2 {
+		t.Errorf("lock = %+v, want an entry per repository", lock)
+	}
+}
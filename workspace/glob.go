@@ -0,0 +1,88 @@
+package workspace
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// expandGlob returns the paths under baseDir matching pattern, relative to
+// baseDir and using forward slashes. Besides the syntax understood by
+// path.Match, a "**" path segment matches any number of directories.
+func expandGlob(baseDir string, pattern string) ([]string, error) {
+	pattern = path.Clean(filepath.ToSlash(pattern))
+
+	if !strings.Contains(pattern, "**") {
+		matches, err := filepath.Glob(filepath.Join(baseDir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, err
+		}
+		result := make([]string, 0, len(matches))
+		for _, m := range matches {
+			rel, err := filepath.Rel(baseDir, m)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, filepath.ToSlash(rel))
+		}
+		return result, nil
+	}
+
+	// Validate the pattern up front, filepath.Walk would otherwise hide it
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	segments := strings.Split(pattern, "/")
+	result := make([]string, 0)
+	err := filepath.Walk(baseDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(baseDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if matchSegments(segments, strings.Split(rel, "/")) {
+			result = append(result, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+// matchGlob reports whether the slash-separated name matches pattern, using
+// the same syntax as expandGlob.
+func matchGlob(pattern string, name string) bool {
+	return matchSegments(strings.Split(path.Clean(pattern), "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,75 @@
+package workspace
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DependencyCycleError is returned when a set of nodes depend on each other.
+// Path lists the nodes along the cycle, starting and ending with the same node.
+type DependencyCycleError struct {
+	Path []string
+}
+
+func (e *DependencyCycleError) Error() string {
+	return fmt.Sprintf("dependency cycle: %s", strings.Join(e.Path, " -> "))
+}
+
+// dependencyOrder walks the graph described by deps, starting at roots, and
+// returns every reachable node ordered so that each node comes after all of
+// its dependencies. Nodes reachable through more than one path are listed
+// once. deps should return an error for unknown nodes.
+func dependencyOrder(roots []string, deps func(node string) ([]string, error)) ([]string, error) {
+	const (
+		visiting = iota + 1
+		visited
+	)
+
+	order := make([]string, 0)
+	state := make(map[string]int)
+	path := make([]string, 0)
+
+	var visit func(node string) error
+	visit = func(node string) error {
+		switch state[node] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for i, n := range path {
+				if n == node {
+					start = i
+					break
+				}
+			}
+			cycle := append([]string{}, path[start:]...)
+			return &DependencyCycleError{Path: append(cycle, node)}
+		}
+
+		edges, err := deps(node)
+		if err != nil {
+			return err
+		}
+
+		state[node] = visiting
+		path = append(path, node)
+		for _, dep := range edges {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[node] = visited
+
+		order = append(order, node)
+		return nil
+	}
+
+	for _, root := range roots {
+		if err := visit(root); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
@@ -0,0 +1,114 @@
+package workspace
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MatrixImageKey is the matrix key that sets the image of the build
+// container instead of a tool version.
+const MatrixImageKey = "os_image"
+
+// BuildMatrix maps a tool name, or MatrixImageKey, to the values a target is
+// built with. A target with a matrix is built once for every combination of
+// values.
+type BuildMatrix map[string][]string
+
+type matrixCell struct {
+	Key   string
+	Value string
+}
+
+// combinations returns every combination of the matrix values. Keys are
+// sorted and the values of each key keep their order, so the result is the
+// same every time.
+func (m BuildMatrix) combinations() [][]matrixCell {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := [][]matrixCell{{}}
+	for _, key := range keys {
+		next := make([][]matrixCell, 0, len(result)*len(m[key]))
+		for _, combination := range result {
+			for _, value := range m[key] {
+				cells := make([]matrixCell, len(combination), len(combination)+1)
+				copy(cells, combination)
+				next = append(next, append(cells, matrixCell{Key: key, Value: value}))
+			}
+		}
+		result = next
+	}
+	return result
+}
+
+// expandMatrix returns one concrete target per combination of the target's
+// matrix, or just the target if it has no matrix. A key naming one of the
+// tools the target is built with, according to its own tools or
+// manifestTools, sets the version of that tool. MatrixImageKey sets the image
+// of the build container. Any other key is an error, as it would only make
+// identical copies of the target. Every value is also exported to the build
+// as YB_MATRIX_<KEY>.
+func (bt BuildTarget) expandMatrix(manifestTools []string) ([]BuildTarget, error) {
+	if len(bt.Matrix) == 0 {
+		return []BuildTarget{bt}, nil
+	}
+
+	knownTools := make(map[string]bool)
+	for _, spec := range append(append([]string{}, manifestTools...), bt.Tools...) {
+		name, _ := splitToolSpec(spec)
+		knownTools[name] = true
+	}
+	for key, values := range bt.Matrix {
+		if key != MatrixImageKey && !knownTools[key] {
+			return nil, fmt.Errorf("Matrix key '%s' of target '%s' is neither a tool it is built with nor %s", key, bt.Name, MatrixImageKey)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("Matrix entry '%s' of target '%s' has no values", key, bt.Name)
+		}
+	}
+
+	targets := make([]BuildTarget, 0)
+	for _, combination := range bt.Matrix.combinations() {
+		tgt := bt
+		tgt.Matrix = nil
+		tgt.Tools = append([]string{}, bt.Tools...)
+		tgt.Environment = make(EnvironmentSet, len(bt.Environment)+1)
+		for name, env := range bt.Environment {
+			tgt.Environment[name] = append([]string{}, env...)
+		}
+
+		labels := make([]string, 0, len(combination))
+		for _, cell := range combination {
+			labels = append(labels, cell.Key+"="+cell.Value)
+			if cell.Key == MatrixImageKey {
+				tgt.Container.Image = cell.Value
+			} else {
+				tgt.Tools = setToolVersion(tgt.Tools, cell.Key, cell.Value)
+			}
+			tgt.Environment[DefaultEnvironment] = append(tgt.Environment[DefaultEnvironment], fmt.Sprintf("YB_MATRIX_%s=%s", strings.ToUpper(cell.Key), cell.Value))
+		}
+		tgt.Name = fmt.Sprintf("%s[%s]", bt.Name, strings.Join(labels, ","))
+
+		targets = append(targets, tgt)
+	}
+
+	return targets, nil
+}
+
+// setToolVersion replaces the version of the named tool in specs, adding it
+// if it isn't there. With the default tools mode a target's version of a tool
+// overrides the manifest's.
+func setToolVersion(specs []string, tool string, version string) []string {
+	spec := tool + ":" + version
+	for i, s := range specs {
+		if name, _ := splitToolSpec(s); name == tool {
+			specs[i] = spec
+			return specs
+		}
+	}
+	return append(specs, spec)
+}
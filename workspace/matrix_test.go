@@ -0,0 +1,101 @@
+package workspace
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestResolveBuildTargetsMatrix(t *testing.T) {
+	var manifest BuildManifest
+	err := yaml.Unmarshal([]byte(`
+dependencies:
+  build:
+    - go:1.14.4
+    - node:12
+build_targets:
+  - name: lint
+  - name: test
+    build_after: [lint]
+    container:
+      image: ubuntu:16.04
+    matrix:
+      go: [1.13, 1.14, 1.15]
+      os_image: [ubuntu:18.04, ubuntu:20.04]
+  - name: release
+    build_after: [test]
+`), &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets, err := manifest.ResolveBuildTargets("release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"lint",
+		"test[go=1.13,os_image=ubuntu:18.04]",
+		"test[go=1.13,os_image=ubuntu:20.04]",
+		"test[go=1.14,os_image=ubuntu:18.04]",
+		"test[go=1.14,os_image=ubuntu:20.04]",
+		"test[go=1.15,os_image=ubuntu:18.04]",
+		"test[go=1.15,os_image=ubuntu:20.04]",
+		"release",
+	}
+	if names := targetNames(targets); !reflect.DeepEqual(names, want) {
+		t.Fatalf("ResolveBuildTargets(release) = %v, want %v", names, want)
+	}
+
+	combination := targets[2]
+	if combination.Container.Image != "ubuntu:20.04" {
+		t.Errorf("image = %s, want ubuntu:20.04", combination.Container.Image)
+	}
+	tools, err := manifest.TargetBuildTools(combination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"go:1.13", "node:12"}; !reflect.DeepEqual(tools, want) {
+		t.Errorf("tools = %v, want %v", tools, want)
+	}
+	if want := []string{"YB_MATRIX_GO=1.13", "YB_MATRIX_OS_IMAGE=ubuntu:20.04"}; !reflect.DeepEqual(combination.Environment["default"], want) {
+		t.Errorf("environment = %v, want %v", combination.Environment, want)
+	}
+	if !reflect.DeepEqual(combination.BuildAfter, []string{"lint"}) {
+		t.Errorf("build_after = %v, want [lint]", combination.BuildAfter)
+	}
+
+	one, err := manifest.ResolveBuildTargets("test[go=1.15,os_image=ubuntu:18.04]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := targetNames(one); !reflect.DeepEqual(names, []string{"lint", "test[go=1.15,os_image=ubuntu:18.04]"}) {
+		t.Errorf("resolving a single combination = %v", names)
+	}
+}
+
+func TestTargetKey(t *testing.T) {
+	if got := targetKey("test[go=1.13,os_image=ubuntu:18.04]"); got != "test_go_1.13_os_image_ubuntu_18.04" {
+		t.Errorf("targetKey = %s", got)
+	}
+	if got := targetKey("default"); got != "default" {
+		t.Errorf("targetKey(default) = %s", got)
+	}
+}
+
+func TestExpandMatrixUnknownKey(t *testing.T) {
+	target := BuildTarget{
+		Name:   "test",
+		Tools:  []string{"python:3.8"},
+		Matrix: BuildMatrix{"pyhton": {"3.7", "3.8"}},
+	}
+	_, err := target.expandMatrix([]string{"go:1.14.4"})
+	if err == nil {
+		t.Fatal("expandMatrix succeeded with a misspelled tool")
+	}
+	if !strings.Contains(err.Error(), "pyhton") {
+		t.Errorf("error %q doesn't name the key", err)
+	}
+}
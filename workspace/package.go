@@ -8,13 +8,17 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/yourbase/narwhal"
 	. "github.com/yourbase/yb/plumbing"
 	"github.com/yourbase/yb/plumbing/log"
+	"github.com/yourbase/yb/plumbing/redact"
 	"github.com/yourbase/yb/runtime"
 	. "github.com/yourbase/yb/types"
 )
@@ -25,6 +29,18 @@ type BuildFlags struct {
 	CleanBuild       bool
 	DependenciesOnly bool
 	ExecPrefix       string
+	Jobs             int
+	Environment      string
+}
+
+// Flags for executing a package
+type ExecFlags struct {
+	// Copy the exec phase's log files into the build root once it exits
+	SaveLogs bool
+	// Don't build the exec phase's build_first targets before running it
+	SkipBuild bool
+	// Restart the exec commands whenever files in the package change
+	Watch bool
 }
 
 type Package struct {
@@ -36,38 +52,198 @@ type Package struct {
 
 var ErrNoManifestFile = errors.New("manifest file not found")
 
+var unsafeKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
 func (p Package) Path() string {
 	return p.path
 }
 
-func (p Package) Build(ctx context.Context, flags BuildFlags, targetName string) ([]CommandTimer, error) {
-	times := make([]CommandTimer, 0)
+// Build builds the named target of the package along with everything it
+// depends on. Targets that don't depend on each other are run concurrently,
+// up to flags.Jobs at a time, each in its own runtime. The returned timers
+// are grouped by target, in build order.
+func (p Package) Build(ctx context.Context, flags BuildFlags, targetName string) ([]TargetTimer, error) {
+	if targetName == "" {
+		targetName = "default"
+	}
+
+	return p.buildTargets(ctx, flags, targetName)
+}
 
+// buildTargets builds the named targets of the package and everything they
+// depend on, like Build. Dependencies they share are only built once. Targets
+// of other packages in the workspace they depend on are built first, one
+// package at a time, and their timers are named like @package:target.
+func (p Package) buildTargets(ctx context.Context, flags BuildFlags, targetNames ...string) ([]TargetTimer, error) {
+	upstream, err := p.upstreamBuilds(targetNames)
+	if err != nil {
+		return nil, err
+	}
+
+	timers := make([]TargetTimer, 0)
+	for _, u := range upstream {
+		log.Infof("Building %s first", u)
+		upstreamTimers, err := u.pkg.buildPackageTargets(ctx, flags, u.target)
+		for _, t := range upstreamTimers {
+			t.Name = fmt.Sprintf("@%s:%s", u.pkg.Name, t.Name)
+			timers = append(timers, t)
+		}
+		if err != nil {
+			return timers, fmt.Errorf("Unable to build %s: %v", u, err)
+		}
+	}
+
+	ownTimers, err := p.buildPackageTargets(ctx, flags, targetNames...)
+	return append(timers, ownTimers...), err
+}
+
+// buildPackageTargets builds the named targets and their dependencies within
+// the package.
+func (p Package) buildPackageTargets(ctx context.Context, flags BuildFlags, targetNames ...string) ([]TargetTimer, error) {
 	manifest := p.Manifest
 
-	if targetName == "" {
-		targetName = "default"
+	tgts, err := manifest.ResolveBuildTargets(targetNames...)
+	if err != nil {
+		return nil, err
+	}
+
+	secretEnv, err := manifest.ResolveSecrets(ctx, p.Path())
+	if err != nil {
+		return nil, err
+	}
+
+	parallel := flags.Jobs > 1 && len(tgts) > 1
+	var outputLock sync.Mutex
+	// Host builds share the environment of the yb process, so only one of
+	// them may run at any given time.
+	var hostLock sync.Mutex
+
+	return runBuildGraph(ctx, tgts, flags.Jobs, func(ctx context.Context, tgt BuildTarget) ([]CommandTimer, error) {
+		if tgt.HostOnly || flags.HostOnly {
+			hostLock.Lock()
+			defer hostLock.Unlock()
+		}
+
+		var output io.Writer = os.Stdout
+		if parallel {
+			w := NewPrefixWriter(os.Stdout, fmt.Sprintf("[%s] ", tgt.Name), &outputLock)
+			defer w.Flush()
+			output = w
+		}
+		redacted := redact.NewWriter(output)
+		defer redacted.Flush()
+
+		tgt.secretEnv = secretEnv
+		return p.buildTarget(ctx, flags, tgt, redacted)
+	})
+}
+
+// prepareTarget applies the manifest's sandbox settings to tgt and reads
+// what it needs from outside its definition: its env files and the artifacts
+// of other packages it depends on. It returns the prepared target along with
+// the tools it needs and its root directory on the host. Building and
+// planning a target both start here, so that they agree on its fingerprint.
+func (p Package) prepareTarget(tgt BuildTarget) (BuildTarget, []string, string, error) {
+	manifest := p.Manifest
+
+	tgt.Sandbox = manifest.IsTargetSandboxed(tgt)
+	tgt.SandboxNetwork = manifest.IsTargetNetworkAllowed(tgt)
+
+	tools, err := manifest.TargetBuildTools(tgt)
+	if err != nil {
+		return tgt, nil, "", err
 	}
 
-	tgts, err := manifest.ResolveBuildTargets(targetName)
+	rootDir, err := tgt.HostRootDir(p.Path())
 	if err != nil {
-		return times, err
+		return tgt, nil, "", err
 	}
 
-	for _, tgt := range tgts {
+	tgt.envFileEnv, err = readEnvFiles(p.Path(), tgt.EnvFiles)
+	if err != nil {
+		return tgt, nil, "", fmt.Errorf("Target '%s': %v", tgt.Name, err)
+	}
 
-		contextId := fmt.Sprintf("%s-build-%s", p.Name, tgt.Name)
-		runtimeCtx := runtime.NewRuntime(ctx, contextId, p.BuildRoot())
+	tgt.upstreamArtifacts, err = p.upstreamArtifacts(tgt)
+	if err != nil {
+		return tgt, nil, "", err
+	}
 
-		buildTimes, err := tgt.Build(ctx, runtimeCtx, os.Stdout, flags, p.Path(), p.Manifest.Dependencies.Build)
+	return tgt, tools, rootDir, nil
+}
+
+// buildTarget builds a single target of the package in a runtime of its own,
+// without regard for its dependencies.
+func (p Package) buildTarget(ctx context.Context, flags BuildFlags, tgt BuildTarget, output io.Writer) ([]CommandTimer, error) {
+	tgt, tools, rootDir, err := p.prepareTarget(tgt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Targets declaring their inputs are skipped when nothing that goes
+	// into them changed since the last successful build
+	fingerprint := ""
+	if len(tgt.Inputs) > 0 && !flags.DependenciesOnly {
+		checkStartTime := time.Now()
+		fingerprint, err = p.targetFingerprint(tgt, rootDir, tools, flags)
+		if err != nil {
+			return nil, err
+		}
+		if fingerprint != "" && !flags.CleanBuild && p.targetUpToDate(tgt, rootDir, fingerprint) {
+			log.Infof("Target '%s' is up to date, skipping it", tgt.Name)
+			return []CommandTimer{{
+				Command:   "[cached]",
+				StartTime: checkStartTime,
+				EndTime:   time.Now(),
+			}}, nil
+		}
+	}
+
+	cacheDir := p.targetCacheDir(tgt, tools)
+	contextId := fmt.Sprintf("%s-build-%s", targetKey(p.Name), targetKey(tgt.Name))
+	runtimeCtx := runtime.NewRuntime(ctx, contextId, p.BuildRoot())
+	if !flags.DependenciesOnly {
+		// Containers with their dependencies installed are left for the
+		// builds that follow
+		defer shutdownRuntime(runtimeCtx)
+	}
+
+	buildTimes, err := tgt.Build(ctx, runtimeCtx, output, flags, p.Path(), cacheDir, tools)
+	if err != nil || flags.DependenciesOnly {
+		return buildTimes, err
+	}
+
+	if len(tgt.Artifacts) > 0 {
+		// The package is mounted into build containers, so artifacts can be
+		// picked up from the host no matter where the target ran.
+		artifactStartTime := time.Now()
+		_, err = tgt.collectArtifacts(rootDir, p.TargetOutputDir(tgt.Name))
+		buildTimes = append(buildTimes, CommandTimer{
+			Command:   "[artifacts]",
+			StartTime: artifactStartTime,
+			EndTime:   time.Now(),
+		})
 		if err != nil {
 			return buildTimes, err
 		}
+	}
 
-		times = append(times, buildTimes...)
+	if fingerprint != "" {
+		if err := p.recordFingerprint(tgt, fingerprint); err != nil {
+			log.Warnf("Unable to record fingerprint of target '%s': %v", tgt.Name, err)
+		}
 	}
 
-	return times, nil
+	return buildTimes, nil
+}
+
+// targetCacheDir returns the host directory holding the cache_paths of a
+// target between container builds. It is keyed by the package, the target
+// and the tools the target installs, so changing the tools starts over with
+// an empty cache.
+func (p Package) targetCacheDir(tgt BuildTarget, tools []string) string {
+	key := fmt.Sprintf("%s-%s", targetKey(tgt.Name), dependenciesChecksum(tools))
+	return filepath.Join(p.BuildRoot(), "cache", p.Name, key)
 }
 
 func LoadPackageAtPath(path string) (Package, error) {
@@ -79,6 +255,21 @@ func (p Package) BuildRoot() string {
 	return p.Workspace.BuildRoot()
 }
 
+// TargetOutputDir returns the directory the artifacts of the named target
+// are collected into, build/output/<package>/<target> in the build root.
+// Packages of a workspace share its build root, so the package is part of
+// the path to keep targets of the same name apart.
+func (p Package) TargetOutputDir(targetName string) string {
+	return filepath.Join(p.BuildRoot(), "output", p.Name, targetKey(targetName))
+}
+
+// targetKey turns a target name into something that can be used in file
+// names and docker network names. Names of matrix targets include the matrix
+// values, brackets and all.
+func targetKey(targetName string) string {
+	return strings.Trim(unsafeKeyChars.ReplaceAllString(targetName, "_"), "_")
+}
+
 func LoadPackage(name string, path string) (Package, error) {
 	manifest := BuildManifest{}
 	buildYaml := filepath.Join(path, MANIFEST_FILE)
@@ -101,15 +292,37 @@ func LoadPackage(name string, path string) (Package, error) {
 	return p, nil
 }
 
-func (p Package) environmentVariables(ctx context.Context, data runtime.RuntimeEnvironmentData, env string) []string {
-	return p.Manifest.Exec.EnvironmentVariables(ctx, env, data)
+// environmentVariables returns the variables for the exec phase, those from
+// its env files overridden by its environment.
+func (p Package) environmentVariables(ctx context.Context, data runtime.RuntimeEnvironmentData, env string) ([]string, error) {
+	fileEnv, err := readEnvFiles(p.Path(), p.Manifest.Exec.ExecEnvFiles())
+	if err != nil {
+		return nil, err
+	}
+	return mergeEnvironment(fileEnv, p.Manifest.Exec.EnvironmentVariables(ctx, env, data)), nil
 }
 
-func (p Package) Execute(ctx context.Context, runtimeCtx *runtime.Runtime) error {
-	return p.ExecuteToWriter(ctx, runtimeCtx, os.Stdout)
+// BuildForExec builds the targets listed in the exec phase's build_first,
+// along with everything they depend on.
+func (p Package) BuildForExec(ctx context.Context) error {
+	targets := p.Manifest.Exec.BuildFirst
+	if len(targets) == 0 {
+		return nil
+	}
+
+	log.Infof("Building %s before executing package '%s'", strings.Join(targets, ", "), p.Name)
+	flags := BuildFlags{Jobs: 1, Environment: DefaultEnvironment}
+	if _, err := p.buildTargets(ctx, flags, targets...); err != nil {
+		return fmt.Errorf("Unable to build %s before exec: %v", strings.Join(targets, ", "), err)
+	}
+	return nil
 }
 
-func (p Package) ExecuteToWriter(ctx context.Context, runtimeCtx *runtime.Runtime, output io.Writer) error {
+func (p Package) Execute(ctx context.Context, runtimeCtx *runtime.Runtime, flags ExecFlags) error {
+	return p.ExecuteToWriter(ctx, runtimeCtx, flags, os.Stdout)
+}
+
+func (p Package) ExecuteToWriter(ctx context.Context, runtimeCtx *runtime.Runtime, flags ExecFlags, output io.Writer) error {
 
 	target, err := p.createExecutionTarget(ctx, runtimeCtx)
 	if err != nil {
@@ -118,13 +331,49 @@ func (p Package) ExecuteToWriter(ctx context.Context, runtimeCtx *runtime.Runtim
 
 	log.Infof("Executing package '%s'...\n", p.Name)
 
+	env, err := p.environmentVariables(ctx, runtimeCtx.EnvironmentData(), DefaultEnvironment)
+	if err != nil {
+		return err
+	}
+
+	workDir := "/workspace"
+
+	// Everything shares the output with the log files from here on, so keep
+	// it from mixing within lines
+	var outputLock sync.Mutex
+	cmdOutput := output
+	if len(p.Manifest.Exec.LogFiles) > 0 {
+		w := NewPrefixWriter(output, "", &outputLock)
+		defer w.Flush()
+		cmdOutput = w
+	}
+	if flags.Watch {
+		err = p.watchExec(ctx, target, workDir, env, flags, output, cmdOutput, &outputLock)
+	} else {
+		stopTailing := p.tailLogFiles(ctx, target, workDir, output, &outputLock)
+		err = p.runExecCommands(ctx, target, workDir, env, cmdOutput, &outputLock)
+		stopTailing()
+	}
+
+	if flags.SaveLogs {
+		if saveErr := p.saveLogFiles(context.Background(), target, workDir); saveErr != nil {
+			log.Warnf("Unable to save log files: %v", saveErr)
+		}
+	}
+
+	return err
+}
+
+// runExecCommands runs the exec phase's commands one after the other, and
+// then its processes.
+func (p Package) runExecCommands(ctx context.Context, target runtime.Target, workDir string, env []string, output io.Writer, outputLock *sync.Mutex) error {
 	for _, cmdString := range p.Manifest.Exec.Commands {
 		proc := runtime.Process{
-			Command:     cmdString,
-			Directory:   "/workspace",
+			Command:     execCommand(cmdString),
+			Directory:   workDir,
 			Interactive: false,
 			Output:      output,
-			Environment: p.environmentVariables(ctx, runtimeCtx.EnvironmentData(), "default"),
+			Environment: env,
 		}
 
 		if err := target.Run(ctx, proc); err != nil {
@@ -132,6 +381,10 @@ func (p Package) ExecuteToWriter(ctx context.Context, runtimeCtx *runtime.Runtim
 		}
 	}
 
+	if len(p.Manifest.Exec.Processes) > 0 {
+		return p.runProcesses(ctx, target, workDir, env, output, outputLock)
+	}
+
 	return nil
 }
 
@@ -163,58 +416,30 @@ func (p Package) createExecutionTarget(ctx context.Context, runtimeCtx *runtime.
 	log.Infof("Will use %s as the dependency work dir", localContainerWorkDir)
 
 	manifest := p.Manifest
-	containers := manifest.Exec.Dependencies.ContainerList()
-	for _, cd := range containers {
+	err := startDependencies(ctx, runtimeCtx, manifest.Exec.Dependencies.Containers, func(cd *narwhal.ContainerDefinition) error {
 		cd.LocalWorkDir = localContainerWorkDir
-		if err := p.checkMounts(&cd, localContainerWorkDir); err != nil {
-			return nil, fmt.Errorf("Unable to set host container mount dir: %v", err)
-		}
-
-		_, err := runtimeCtx.AddContainer(ctx, cd)
-		if err != nil {
-			return nil, fmt.Errorf("Couldn't start container dependency: %v", err)
+		if err := p.checkMounts(cd, localContainerWorkDir); err != nil {
+			return fmt.Errorf("Unable to set host container mount dir: %v", err)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't start container dependency: %v", err)
 	}
 
-	// TODO: Support UDP
-	portMappings := make([]string, 0)
-
-	for _, entry := range p.Manifest.Exec.Ports {
-		localPort := ""
-		remotePort := ""
-		parts := strings.Split(entry, ":")
-
-		if len(parts) == 2 {
-			localPort = parts[0]
-			remotePort = parts[1]
-		} else {
-			if runtime.HostOS() == runtime.Linux {
-				log.Infof("No host port specified for port %s - will use %s externaly", entry, entry)
-				localPort = entry
-			} else {
-				log.Infof("Docker is not running natively, will try to pick a random port for %s", entry)
-				p, err := runtime.GetFreePort()
-				if err != nil {
-					log.Warnf("Could not find local port for container port %s: %v", entry, err)
-				} else {
-					localPort = fmt.Sprintf("%d", p)
-				}
-			}
-
-			remotePort = entry
-		}
-
-		if localPort != "" && remotePort != "" {
-			mapString := fmt.Sprintf("%s:%s", localPort, remotePort)
-			portMappings = append(portMappings, mapString)
-		}
+	portMappings, err := hostPortMappings(p.Manifest.Exec.Ports)
+	if err != nil {
+		return nil, err
+	}
 
-		log.Infof("Mapping container port %s to %s on the local machine", remotePort, localPort)
+	execEnv, err := p.environmentVariables(ctx, runtimeCtx.EnvironmentData(), DefaultEnvironment)
+	if err != nil {
+		return nil, err
 	}
 
 	execContainer := manifest.Exec.Container
-	execContainer.Environment = manifest.Exec.EnvironmentVariables(ctx, "default", runtimeCtx.EnvironmentData())
-	execContainer.Command = "/usr/bin/tail -f /dev/null"
+	execContainer.Environment = execEnv
+	execContainer.Command = runtime.IdleCommand
 	execContainer.Label = p.Name
 	execContainer.Ports = portMappings
 
@@ -239,6 +464,42 @@ func (p Package) createExecutionTarget(ctx context.Context, runtimeCtx *runtime.
 	return execTarget, nil
 }
 
+// hostPortMappings parses port mappings, as read by runtime.ParsePortMapping,
+// and picks host ports for those that leave them out: the same ports when
+// Docker runs natively, and otherwise a free port or, for ranges, whatever
+// Docker picks.
+func hostPortMappings(specs []string) ([]string, error) {
+	mappings := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		m, err := runtime.ParsePortMapping(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.HostPort.IsZero() {
+			switch {
+			case runtime.HostOS() == runtime.Linux:
+				log.Infof("No host port specified for port %s - will use %s externally", spec, m.ContainerPort)
+				m.HostPort = m.ContainerPort
+			case m.ContainerPort.Len() == 1:
+				log.Infof("Docker is not running natively, will try to pick a random port for %s", spec)
+				port, err := runtime.GetFreePort()
+				if err != nil {
+					log.Warnf("Could not find local port for container port %s: %v", spec, err)
+				} else {
+					m.HostPort = runtime.PortRange{Start: port, End: port}
+				}
+			default:
+				log.Infof("Docker is not running natively, it will pick the host ports for %s", spec)
+			}
+		}
+
+		log.Infof("Mapping container port %s/%s to %s on the local machine", m.ContainerPort, m.Protocol, m.HostPort)
+		mappings = append(mappings, m.String())
+	}
+	return mappings, nil
+}
+
 func (p Package) RuntimeContainers() []narwhal.ContainerDefinition {
 	m := p.Manifest
 
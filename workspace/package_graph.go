@@ -0,0 +1,155 @@
+package workspace
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Directory artifacts of targets in other packages are mounted under in
+// build containers
+const upstreamArtifactsDir = "/yb/artifacts"
+
+// isPackageRef reports whether a build_after entry refers to a target of
+// another package, like "@protos:default".
+func isPackageRef(name string) bool {
+	return strings.HasPrefix(name, "@")
+}
+
+// parsePackageRef splits a reference like "@protos:compile" into the package
+// and the target. Leaving out the target, as in "@protos", means its default
+// target.
+func parsePackageRef(ref string) (pkgName string, targetName string, err error) {
+	if !isPackageRef(ref) {
+		return "", "", fmt.Errorf("'%s' doesn't refer to another package", ref)
+	}
+	parts := strings.SplitN(ref[1:], ":", 2)
+	pkgName = parts[0]
+	targetName = "default"
+	if len(parts) == 2 && parts[1] != "" {
+		targetName = parts[1]
+	}
+	if pkgName == "" {
+		return "", "", fmt.Errorf("'%s' doesn't name a package", ref)
+	}
+	return pkgName, targetName, nil
+}
+
+// upstreamBuild is a target of another package that has to be built first.
+type upstreamBuild struct {
+	pkg    Package
+	target string
+}
+
+func (u upstreamBuild) String() string {
+	return fmt.Sprintf("@%s:%s", u.pkg.Name, u.target)
+}
+
+// packageByName finds a package of the same workspace as p.
+func (p Package) packageByName(name string) (Package, error) {
+	if p.Workspace == nil {
+		return Package{}, fmt.Errorf("package '%s' isn't part of a workspace", p.Name)
+	}
+	return p.Workspace.PackageByName(name)
+}
+
+// upstreamBuilds returns the targets of other packages in the workspace that
+// the named targets of p depend on through @package:target references in
+// build_after, directly or through yet other packages. They are ordered so
+// that each one comes after everything it depends on.
+func (p Package) upstreamBuilds(targetNames []string) ([]upstreamBuild, error) {
+	// The named targets of p are the root node, with the empty key
+	nodes := map[string]upstreamBuild{"": {pkg: p}}
+
+	order, err := dependencyOrder([]string{""}, func(key string) ([]string, error) {
+		node := nodes[key]
+		names := targetNames
+		if key != "" {
+			names = []string{node.target}
+		}
+
+		tgts, err := node.pkg.Manifest.ResolveBuildTargets(names...)
+		if err != nil {
+			if key != "" {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			return nil, err
+		}
+
+		deps := make([]string, 0)
+		for _, tgt := range tgts {
+			for _, dep := range tgt.BuildAfter {
+				if !isPackageRef(dep) {
+					continue
+				}
+				pkgName, targetName, err := parsePackageRef(dep)
+				if err != nil {
+					return nil, fmt.Errorf("Target '%s': %v", tgt.Name, err)
+				}
+				upstream, err := node.pkg.packageByName(pkgName)
+				if err != nil {
+					return nil, fmt.Errorf("Target '%s' depends on %s: %v", tgt.Name, dep, err)
+				}
+				u := upstreamBuild{pkg: upstream, target: targetName}
+				nodes[u.String()] = u
+				deps = append(deps, u.String())
+			}
+		}
+		return deps, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]upstreamBuild, 0, len(order)-1)
+	for _, key := range order {
+		if key != "" {
+			result = append(result, nodes[key])
+		}
+	}
+	return result, nil
+}
+
+// upstreamArtifact is where the artifacts of a target of another package
+// are found by a target depending on it.
+type upstreamArtifact struct {
+	// The @package:target reference
+	Ref string
+	// Output directory of the upstream target on the host
+	HostDir string
+	// Where the directory is mounted in build containers
+	ContainerDir string
+}
+
+// EnvVar returns the name of the variable holding the path to the artifacts,
+// like YB_ARTIFACTS_PROTOS_DEFAULT.
+func (a upstreamArtifact) EnvVar() string {
+	pkgName, targetName, _ := parsePackageRef(a.Ref)
+	key := strings.ToUpper(targetKey(pkgName + "_" + targetName))
+	return "YB_ARTIFACTS_" + strings.NewReplacer(".", "_", "-", "_").Replace(key)
+}
+
+// upstreamArtifacts returns where tgt finds the artifacts of the targets of
+// other packages it lists in build_after.
+func (p Package) upstreamArtifacts(tgt BuildTarget) ([]upstreamArtifact, error) {
+	result := make([]upstreamArtifact, 0)
+	for _, dep := range tgt.BuildAfter {
+		if !isPackageRef(dep) {
+			continue
+		}
+		pkgName, targetName, err := parsePackageRef(dep)
+		if err != nil {
+			return nil, fmt.Errorf("Target '%s': %v", tgt.Name, err)
+		}
+		upstream, err := p.packageByName(pkgName)
+		if err != nil {
+			return nil, fmt.Errorf("Target '%s' depends on %s: %v", tgt.Name, dep, err)
+		}
+		result = append(result, upstreamArtifact{
+			Ref:          dep,
+			HostDir:      upstream.TargetOutputDir(targetName),
+			ContainerDir: path.Join(upstreamArtifactsDir, pkgName, targetKey(targetName)),
+		})
+	}
+	return result, nil
+}
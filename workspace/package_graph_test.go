@@ -0,0 +1,152 @@
+package workspace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testWorkspace returns a workspace in dir holding packages with the given
+// manifests.
+func testWorkspace(t *testing.T, dir string, manifests map[string]BuildManifest) *Workspace {
+	ws := &Workspace{Path: dir}
+	for name, manifest := range manifests {
+		pkgDir := filepath.Join(dir, name)
+		if err := os.MkdirAll(pkgDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		ws.packages = append(ws.packages, Package{
+			Name:      name,
+			path:      pkgDir,
+			Manifest:  manifest,
+			Workspace: ws,
+		})
+	}
+	return ws
+}
+
+func TestParsePackageRef(t *testing.T) {
+	tests := []struct {
+		ref, pkg, target string
+	}{
+		{ref: "@protos:compile", pkg: "protos", target: "compile"},
+		{ref: "@protos", pkg: "protos", target: "default"},
+		{ref: "@protos:", pkg: "protos", target: "default"},
+		{ref: "@base:test[os_image=ubuntu:18.04]", pkg: "base", target: "test[os_image=ubuntu:18.04]"},
+	}
+	for _, tt := range tests {
+		pkg, target, err := parsePackageRef(tt.ref)
+		if err != nil || pkg != tt.pkg || target != tt.target {
+			t.Errorf("parsePackageRef(%q) = %q, %q, %v; want %q, %q", tt.ref, pkg, target, err, tt.pkg, tt.target)
+		}
+	}
+	if _, _, err := parsePackageRef("@:compile"); err == nil {
+		t.Error("parsePackageRef succeeded without a package")
+	}
+}
+
+func TestUpstreamBuilds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ws := testWorkspace(t, dir, map[string]BuildManifest{
+		"api": {BuildTargets: []BuildTarget{
+			{Name: "lint"},
+			{Name: "default", BuildAfter: []string{"lint", "@protos:compile", "@common"}},
+		}},
+		"protos": {BuildTargets: []BuildTarget{
+			{Name: "compile", BuildAfter: []string{"@common"}},
+		}},
+		"common": {BuildTargets: []BuildTarget{
+			{Name: "default"},
+		}},
+	})
+	api, err := ws.PackageByName("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tgts, err := api.Manifest.ResolveBuildTargets("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := targetNames(tgts); !reflect.DeepEqual(names, []string{"lint", "default"}) {
+		t.Errorf("ResolveBuildTargets(default) = %v, want only the package's own targets", names)
+	}
+
+	upstream, err := api.upstreamBuilds([]string{"default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(upstream))
+	for _, u := range upstream {
+		names = append(names, u.String())
+	}
+	if want := []string{"@common:default", "@protos:compile"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("upstreamBuilds = %v, want %v", names, want)
+	}
+
+	artifacts, err := api.upstreamArtifacts(tgts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts) != 2 {
+		t.Fatalf("upstreamArtifacts = %+v, want two", artifacts)
+	}
+	protos := artifacts[0]
+	if want := filepath.Join(dir, "build", "output", "protos", "compile"); protos.HostDir != want {
+		t.Errorf("host dir = %s, want %s", protos.HostDir, want)
+	}
+	if protos.ContainerDir != "/yb/artifacts/protos/compile" {
+		t.Errorf("container dir = %s", protos.ContainerDir)
+	}
+	if protos.EnvVar() != "YB_ARTIFACTS_PROTOS_COMPILE" {
+		t.Errorf("env var = %s", protos.EnvVar())
+	}
+
+	plan, err := api.Plan(BuildFlags{HostOnly: true}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	planned := make([]string, 0)
+	for _, tp := range plan.Targets {
+		planned = append(planned, tp.Name)
+	}
+	if want := []string{"@common:default", "@protos:compile", "lint", "default"}; !reflect.DeepEqual(planned, want) {
+		t.Errorf("planned targets = %v, want %v", planned, want)
+	}
+}
+
+func TestUpstreamBuildsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ws := testWorkspace(t, dir, map[string]BuildManifest{
+		"a": {BuildTargets: []BuildTarget{
+			{Name: "default", BuildAfter: []string{"@b"}},
+			{Name: "orphan", BuildAfter: []string{"@missing"}},
+		}},
+		"b": {BuildTargets: []BuildTarget{
+			{Name: "default", BuildAfter: []string{"@a:default"}},
+		}},
+	})
+	a, _ := ws.PackageByName("a")
+
+	if _, err := a.upstreamBuilds([]string{"default"}); err == nil {
+		t.Error("upstreamBuilds succeeded with a cycle across packages")
+	} else if _, ok := err.(*DependencyCycleError); !ok {
+		t.Errorf("upstreamBuilds error = %v, want *DependencyCycleError", err)
+	}
+
+	if _, err := a.upstreamBuilds([]string{"orphan"}); err == nil {
+		t.Error("upstreamBuilds succeeded with an unknown package")
+	}
+}
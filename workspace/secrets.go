@@ -0,0 +1,115 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/shlex"
+	"github.com/joho/godotenv"
+	"github.com/yourbase/yb/plumbing"
+	"github.com/yourbase/yb/plumbing/redact"
+)
+
+// SecretsFile holds KEY=value lines for secrets that don't name a command.
+// It lives in the yb config dir, ~/.config/yb.
+const SecretsFile = "secrets.env"
+
+// Secret names an environment variable whose value comes from the local
+// secret store, either the secrets file or the output of a command, rather
+// than from the manifest.
+type Secret struct {
+	Name     string `yaml:"name"`
+	Key      string `yaml:"key"`
+	Command  string `yaml:"command"`
+	Optional bool   `yaml:"optional"`
+}
+
+// SecretNames returns the names of the variables the manifest's secrets are
+// exported as.
+func (b BuildManifest) SecretNames() []string {
+	names := make([]string, 0, len(b.Secrets))
+	for _, s := range b.Secrets {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+// ResolveSecrets looks up the value of every secret in the manifest and
+// returns them as KEY=value environment variables. Every value is registered
+// with the redact package, so it never shows up in yb's output. Commands run
+// in dir.
+func (b BuildManifest) ResolveSecrets(ctx context.Context, dir string) ([]string, error) {
+	env := make([]string, 0, len(b.Secrets))
+
+	var fileSecrets map[string]string
+	secretsFile := plumbing.ConfigFilePath(SecretsFile)
+
+	for _, secret := range b.Secrets {
+		if secret.Name == "" {
+			return env, fmt.Errorf("Secret without a name in build manifest")
+		}
+
+		var value string
+		found := false
+		if secret.Command != "" {
+			v, err := secretFromCommand(ctx, secret.Command, dir)
+			if err != nil {
+				return env, fmt.Errorf("Unable to get secret '%s': %v", secret.Name, err)
+			}
+			value, found = v, true
+		} else {
+			if fileSecrets == nil {
+				fileSecrets = make(map[string]string)
+				if plumbing.PathExists(secretsFile) {
+					read, err := godotenv.Read(secretsFile)
+					if err != nil {
+						return env, fmt.Errorf("Unable to read secrets file %s: %v", secretsFile, err)
+					}
+					fileSecrets = read
+				}
+			}
+			key := secret.Key
+			if key == "" {
+				key = secret.Name
+			}
+			value, found = fileSecrets[key]
+		}
+
+		if !found {
+			if secret.Optional {
+				continue
+			}
+			return env, fmt.Errorf("Secret '%s' not found in %s", secret.Name, secretsFile)
+		}
+
+		redact.Add(value)
+		env = append(env, fmt.Sprintf("%s=%s", secret.Name, value))
+	}
+
+	return env, nil
+}
+
+func secretFromCommand(ctx context.Context, command string, dir string) (string, error) {
+	cmdArgs, err := shlex.Split(command)
+	if err != nil {
+		return "", fmt.Errorf("Can't parse command string '%s': %v", command, err)
+	}
+	if len(cmdArgs) == 0 {
+		return "", fmt.Errorf("Empty command")
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Command '%s' failed: %v", command, err)
+	}
+
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
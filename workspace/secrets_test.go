@@ -0,0 +1,35 @@
+package workspace
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/yourbase/yb/plumbing/redact"
+)
+
+func TestResolveSecretsFromCommand(t *testing.T) {
+	defer redact.Reset()
+
+	manifest := BuildManifest{
+		Secrets: []Secret{
+			{Name: "API_TOKEN", Command: "echo tok-12345"},
+		},
+	}
+	env, err := manifest.ResolveSecrets(context.Background(), os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"API_TOKEN=tok-12345"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("ResolveSecrets = %q, want %q", env, want)
+	}
+	if got := redact.String("token is tok-12345"); got != "token is ***" {
+		t.Errorf("secret wasn't registered for redaction: %q", got)
+	}
+
+	manifest.Secrets = []Secret{{Name: "MISSING", Command: "false"}}
+	if _, err := manifest.ResolveSecrets(context.Background(), os.TempDir()); err == nil {
+		t.Error("ResolveSecrets didn't fail when the command failed")
+	}
+}
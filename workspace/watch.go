@@ -0,0 +1,478 @@
+package workspace
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yourbase/yb/plumbing/log"
+	"github.com/yourbase/yb/runtime"
+)
+
+const (
+	// How often the package tree is checked for changes
+	watchPollInterval = 500 * time.Millisecond
+	// How long the tree has to stay unchanged before changes are reported
+	watchDebounce = 300 * time.Millisecond
+)
+
+// ignoreRule is a single line of a .gitignore file.
+type ignoreRule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreList decides which paths are ignored, following the syntax of
+// .gitignore files: the last matching rule wins, "!" negates a rule, a
+// trailing "/" only matches directories and patterns without a "/" match at
+// any depth. Patterns may use "**" like expandGlob.
+type ignoreList []ignoreRule
+
+func parseIgnoreRules(lines []string) ignoreList {
+	rules := make(ignoreList, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.HasPrefix(line, "/") {
+			line = strings.TrimLeft(line, "/")
+		} else if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// readIgnoreFile reads the rules of a .gitignore file. A missing file has no
+// rules.
+func readIgnoreFile(file string) (ignoreList, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return parseIgnoreRules(lines), scanner.Err()
+}
+
+// under anchors the rules of a .gitignore file in the slash-separated
+// directory base, relative to the root of the list.
+func (l ignoreList) under(base string) ignoreList {
+	if base == "" || base == "." {
+		return l
+	}
+	result := make(ignoreList, len(l))
+	for i, rule := range l {
+		rule.pattern = base + "/" + rule.pattern
+		result[i] = rule
+	}
+	return result
+}
+
+// ignored reports whether the slash-separated path, relative to the root of
+// the list, is ignored.
+func (l ignoreList) ignored(name string, isDir bool) bool {
+	return l.apply(false, name, isDir)
+}
+
+// apply returns whether the path is ignored once the rules of the list are
+// applied on top of ignored, the result of rules that come before them.
+func (l ignoreList) apply(ignored bool, name string, isDir bool) bool {
+	for _, rule := range l {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matchGlob(rule.pattern, name) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// treeWatcher polls a directory tree for changes to files that aren't
+// ignored. There are no file system notifications involved: every
+// watchPollInterval the whole tree is walked again, which is cheap for
+// source trees but not for huge ones, so big directories like dependencies
+// are best ignored.
+//
+// Files are ignored like git does, with paths matched relative to the root
+// of the git repository holding the tree: by .git/info/exclude, then the
+// .gitignore files of the directories above the tree and of each directory
+// in it, deeper ones taking precedence. The override rules come last.
+type treeWatcher struct {
+	root string
+	// Path of root relative to the root of its git repository, slash-separated
+	prefix string
+	// Rules from .git/info/exclude and the .gitignore files above root
+	base ignoreList
+	// Rules that take precedence over every .gitignore file
+	override ignoreList
+	// Absolute directories that are never watched
+	skipDirs []string
+
+	files map[string]fileState
+}
+
+// newWatcher returns a watcher for the package's tree. It skips .git, the
+// build root, whatever git ignores and the exec phase's watch_ignore
+// patterns.
+func (p Package) newWatcher() (*treeWatcher, error) {
+	root := p.Path()
+	w := &treeWatcher{
+		root:     root,
+		skipDirs: []string{p.BuildRoot()},
+	}
+
+	var err error
+	w.prefix, w.base, err = repoIgnoreRules(root)
+	if err != nil {
+		return nil, err
+	}
+
+	w.override = parseIgnoreRules([]string{".git/"})
+	w.override = append(w.override, parseIgnoreRules(p.Manifest.Exec.WatchIgnore).under(w.prefix)...)
+
+	w.files, err = w.scan()
+	return w, err
+}
+
+// repoIgnoreRules returns the ignore rules of the git repository root is in
+// that apply to it from outside: .git/info/exclude and the .gitignore files of
+// the directories above it. Their patterns are relative to the top of the
+// repository, and prefix is the slash-separated path of root from there, ""
+// if root is the top or isn't in a repository at all.
+func repoIgnoreRules(root string) (prefix string, base ignoreList, err error) {
+	gitRoot := gitRootOf(root)
+	if gitRoot == "" {
+		return "", nil, nil
+	}
+	rel, err := filepath.Rel(gitRoot, root)
+	if err != nil {
+		return "", nil, err
+	}
+	prefix = filepath.ToSlash(rel)
+	if prefix == "." {
+		prefix = ""
+	}
+
+	base, err = readIgnoreFile(filepath.Join(gitRoot, ".git", "info", "exclude"))
+	if err != nil {
+		return "", nil, err
+	}
+	for dir := gitRoot; dir != root; {
+		rules, err := readIgnoreFile(filepath.Join(dir, ".gitignore"))
+		if err != nil {
+			return "", nil, err
+		}
+		rel, _ := filepath.Rel(gitRoot, dir)
+		base = append(base, rules.under(filepath.ToSlash(rel))...)
+
+		next, _ := filepath.Rel(dir, root)
+		dir = filepath.Join(dir, strings.SplitN(next, string(filepath.Separator), 2)[0])
+	}
+	return prefix, base, nil
+}
+
+// withIgnoreFile returns inherited followed by the rules of the .gitignore
+// file in dir, if it has one. base is the slash-separated path of dir from
+// the top of the repository.
+func withIgnoreFile(inherited ignoreList, dir string, base string) (ignoreList, error) {
+	own, err := readIgnoreFile(filepath.Join(dir, ".gitignore"))
+	if err != nil || len(own) == 0 {
+		return inherited, err
+	}
+	return append(inherited[:len(inherited):len(inherited)], own.under(base)...), nil
+}
+
+// gitRootOf returns the closest directory containing dir that has a .git
+// directory, or "" if there is none.
+func gitRootOf(dir string) string {
+	for {
+		if info, err := os.Stat(filepath.Join(dir, ".git")); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// scan returns the state of every file in the tree.
+func (w *treeWatcher) scan() (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	// Rules that apply to the entries of each directory walked, by its path
+	// relative to the root
+	rules := make(map[string]ignoreList)
+	dirRules := func(rel string, inherited ignoreList) (err error) {
+		rules[rel], err = withIgnoreFile(inherited, filepath.Join(w.root, filepath.FromSlash(rel)), path.Join(w.prefix, rel))
+		return err
+	}
+
+	err := filepath.Walk(w.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may go away while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(w.root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return dirRules(rel, w.base)
+		}
+
+		inherited := rules[path.Dir(rel)]
+		name := path.Join(w.prefix, rel)
+		ignored := w.override.apply(inherited.ignored(name, info.IsDir()), name, info.IsDir())
+
+		if info.IsDir() {
+			for _, dir := range w.skipDirs {
+				if p == dir {
+					return filepath.SkipDir
+				}
+			}
+			if ignored {
+				return filepath.SkipDir
+			}
+			return dirRules(rel, inherited)
+		}
+		if ignored {
+			return nil
+		}
+		files[rel] = fileState{modTime: info.ModTime(), size: info.Size()}
+		return nil
+	})
+	return files, err
+}
+
+// changes returns the files that were added, changed or removed since the
+// last call, sorted.
+func (w *treeWatcher) changes() ([]string, error) {
+	files, err := w.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]string, 0)
+	for name, state := range files {
+		if old, ok := w.files[name]; !ok || old != state {
+			changed = append(changed, name)
+		}
+	}
+	for name := range w.files {
+		if _, ok := files[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	w.files = files
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// wait blocks until files in the tree change and then stay unchanged for
+// a little while, and returns the files that changed.
+func (w *treeWatcher) wait(ctx context.Context) ([]string, error) {
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	changed := make(map[string]struct{})
+	var lastChange time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		names, err := w.changes()
+		if err != nil {
+			log.Warnf("Unable to look for changes in %s: %v", w.root, err)
+			continue
+		}
+		if len(names) > 0 {
+			for _, name := range names {
+				changed[name] = struct{}{}
+			}
+			lastChange = time.Now()
+			continue
+		}
+		if len(changed) > 0 && time.Since(lastChange) >= watchDebounce {
+			result := make([]string, 0, len(changed))
+			for name := range changed {
+				result = append(result, name)
+			}
+			sort.Strings(result)
+			return result, nil
+		}
+	}
+}
+
+// watchExec runs the exec phase's commands in target, the exec container,
+// and restarts them whenever files in the package change, after building the
+// build_first targets again. The container and its dependencies keep running
+// throughout. It returns once ctx is done.
+func (p Package) watchExec(ctx context.Context, target runtime.Target, workDir string, env []string, flags ExecFlags, output io.Writer, cmdOutput io.Writer, outputLock *sync.Mutex) error {
+	w, err := p.newWatcher()
+	if err != nil {
+		return fmt.Errorf("Unable to watch %s: %v", p.Path(), err)
+	}
+
+	changes := make(chan []string)
+	go func() {
+		for {
+			names, err := w.wait(ctx)
+			if err != nil {
+				return
+			}
+			select {
+			case changes <- names:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	run := func() (chan error, context.CancelFunc) {
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			stopTailing := p.tailLogFiles(runCtx, target, workDir, output, outputLock)
+			err := p.runExecCommands(runCtx, target, workDir, env, cmdOutput, outputLock)
+			stopTailing()
+			done <- err
+		}()
+		return done, cancel
+	}
+
+	log.Infof("Watching %s for changes", p.Path())
+	start := true
+	var done chan error
+	cancel := func() {}
+	for {
+		if start {
+			done, cancel = run()
+		}
+
+		select {
+		case err := <-done:
+			cancel()
+			done = nil
+			if err != nil {
+				log.Errorf("Exec commands failed: %v", err)
+			} else {
+				log.Infof("Exec commands finished")
+			}
+			log.Infof("Waiting for changes to run them again...")
+			start = false
+			continue
+
+		case names := <-changes:
+			log.Infof("Changed: %s", describeChanges(names))
+			if done != nil {
+				log.Infof("Restarting exec commands")
+				cancel()
+				stopExecCommands(target, done)
+				done = nil
+			}
+
+		case <-ctx.Done():
+			if done != nil {
+				cancel()
+				stopExecCommands(target, done)
+			}
+			return nil
+		}
+
+		start = true
+		if !flags.SkipBuild {
+			if err := p.BuildForExec(ctx); err != nil {
+				log.Errorf("%v", err)
+				log.Infof("Waiting for changes to try again...")
+				start = false
+			}
+		}
+	}
+}
+
+// stopExecCommands stops the exec command running in the exec container
+// target, along with anything it started, and waits for the exec commands to
+// return on done. Processes are stopped by runProcesses itself once its
+// context is cancelled. Nothing else in the container, like processes started
+// by hand, is touched.
+func stopExecCommands(target runtime.Target, done <-chan error) {
+	signal := func(sig string) {
+		cmd := fmt.Sprintf("kill -%s -- -$(cat %s) 2>/dev/null; true", sig, execCommandPidFile)
+		if err := target.Run(context.Background(), runtime.Process{Command: cmd, Output: ioutil.Discard}); err != nil {
+			log.Warnf("Unable to stop exec commands: %v", err)
+		}
+	}
+
+	signal("TERM")
+	select {
+	case <-done:
+		return
+	case <-time.After(processStopTimeout):
+	}
+
+	log.Warnf("Exec commands didn't stop within %s, killing them", processStopTimeout)
+	signal("KILL")
+	select {
+	case <-done:
+	case <-time.After(processStopTimeout):
+		log.Warnf("Exec commands still didn't stop, starting over anyway")
+	}
+}
+
+// describeChanges summarizes changed files for the log.
+func describeChanges(names []string) string {
+	const max = 3
+	if len(names) <= max {
+		return strings.Join(names, ", ")
+	}
+	return strings.Join(names[:max], ", ") + ", ..."
+}
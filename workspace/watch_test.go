@@ -0,0 +1,250 @@
+package workspace
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	goruntime "runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yourbase/yb/runtime"
+)
+
+func TestIgnoreList(t *testing.T) {
+	ignore := parseIgnoreRules([]string{
+		"# build output",
+		"*.log",
+		"!keep.log",
+		"/dist",
+		"node_modules/",
+		"docs/**/*.html",
+	})
+
+	tests := []struct {
+		name  string
+		isDir bool
+		want  bool
+	}{
+		{name: "server.log", want: true},
+		{name: "logs/server.log", want: true},
+		{name: "logs/keep.log", want: false},
+		{name: "dist", isDir: true, want: true},
+		{name: "src/dist", isDir: true, want: false},
+		{name: "node_modules", isDir: true, want: true},
+		{name: "web/node_modules", isDir: true, want: true},
+		{name: "node_modules", want: false},
+		{name: "docs/api/index.html", want: true},
+		{name: "docs/index.html", want: true},
+		{name: "main.go", want: false},
+	}
+	for _, tt := range tests {
+		if got := ignore.ignored(tt.name, tt.isDir); got != tt.want {
+			t.Errorf("ignored(%q, %t) = %t, want %t", tt.name, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestTreeWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkgDir := filepath.Join(dir, "pkg")
+	writeFile := func(name, content string) {
+		t.Helper()
+		p := filepath.Join(pkgDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(".gitignore", "*.log\n")
+	writeFile("main.go", "package main\n")
+
+	pkg := Package{
+		Name:      "pkg",
+		path:      pkgDir,
+		Workspace: &Workspace{Path: dir},
+		Manifest:  BuildManifest{Exec: ExecPhase{WatchIgnore: []string{"tmp/"}}},
+	}
+	w, err := pkg.newWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile("server.log", "ignored")
+	writeFile("tmp/cache", "ignored")
+	writeFile(".git/HEAD", "ignored")
+	writeFile("main.go", "package main\n\nfunc main() {}\n")
+	writeFile("lib/lib.go", "package lib\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	changed, err := w.wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"lib/lib.go", "main.go"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed = %v, want %v", changed, want)
+	}
+
+	if err := os.Remove(filepath.Join(pkgDir, "lib", "lib.go")); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = w.changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"lib/lib.go"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed after removal = %v, want %v", changed, want)
+	}
+}
+
+func TestTreeWatcherGitIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yb-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name, content string) {
+		t.Helper()
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(".git/info/exclude", "*.tmp\n")
+	writeFile(".gitignore", "/services/api/generated/\n")
+	writeFile("services/.gitignore", "*.out\n")
+	writeFile("services/api/sub/.gitignore", "*.json\n!keep.out\n")
+	writeFile("services/api/main.go", "package main\n")
+	writeFile("services/api/scratch.tmp", "ignored")
+	writeFile("services/api/generated/api.go", "ignored")
+	writeFile("services/api/a.out", "ignored")
+	writeFile("services/api/sub/keep.out", "kept")
+	writeFile("services/api/sub/data.json", "ignored")
+	writeFile("services/api/other/data.json", "kept")
+
+	pkg := Package{
+		Name:      "api",
+		path:      filepath.Join(dir, "services", "api"),
+		Workspace: &Workspace{Path: dir},
+	}
+	w, err := pkg.newWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(w.files))
+	for name := range w.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{"main.go", "other/data.json", "sub/.gitignore", "sub/keep.out"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("watched files = %v, want %v", names, want)
+	}
+}
+
+// shellTarget runs processes with bash on the host, writing the PID of the
+// exec command into pidFile instead of execCommandPidFile.
+type shellTarget struct {
+	runtime.Target
+	pidFile string
+}
+
+func (t shellTarget) Run(ctx context.Context, p runtime.Process) error {
+	cmd := exec.CommandContext(ctx, "bash", "-c", strings.Replace(p.Command, execCommandPidFile, t.pidFile, -1))
+	cmd.Dir = p.Directory
+	cmd.Stdout = p.Output
+	cmd.Stderr = ioutil.Discard
+	return cmd.Run()
+}
+
+func TestStopExecCommands(t *testing.T) {
+	if goruntime.GOOS != "linux" {
+		t.Skip("needs /proc")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not found")
+	}
+	dir, err := ioutil.TempDir("", "yb-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Something else running in the container, which has to survive
+	other := exec.Command("sleep", "30")
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Wait()
+	defer other.Process.Kill()
+
+	childPidFile := filepath.Join(dir, "child.pid")
+	pkg := Package{Manifest: BuildManifest{Exec: ExecPhase{
+		Commands: []string{"sleep 30 & echo $! > " + childPidFile + "; sleep 30"},
+	}}}
+	target := shellTarget{pidFile: filepath.Join(dir, "exec.pid")}
+
+	done := make(chan error, 1)
+	go func() {
+		var mu sync.Mutex
+		done <- pkg.runExecCommands(context.Background(), target, dir, nil, ioutil.Discard, &mu)
+	}()
+
+	var child int
+	for start := time.Now(); child == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("exec command didn't start")
+		}
+		if _, err := os.Stat(target.pidFile); err != nil {
+			continue
+		}
+		data, _ := ioutil.ReadFile(childPidFile)
+		child, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+
+	start := time.Now()
+	stopExecCommands(target, done)
+	if elapsed := time.Since(start); elapsed >= processStopTimeout {
+		t.Errorf("stopExecCommands took %s, want the command to stop on SIGTERM", elapsed)
+	}
+
+	for start := time.Now(); processRunning(child); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("process %d started by the exec command is still running", child)
+			break
+		}
+	}
+	if !processRunning(other.Process.Pid) {
+		t.Errorf("process %d not started by the exec command was stopped", other.Process.Pid)
+	}
+}
+
+// processRunning reports whether pid is alive and not a zombie.
+func processRunning(pid int) bool {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
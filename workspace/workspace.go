@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -15,11 +16,18 @@ import (
 	. "github.com/yourbase/yb/plumbing"
 	"github.com/yourbase/yb/plumbing/log"
 	"github.com/yourbase/yb/runtime"
+	. "github.com/yourbase/yb/types"
 )
 
 type Workspace struct {
-	Target   string `yaml:"target"`
-	Path     string
+	Target string `yaml:"target"`
+	Path   string
+	// Packages, if set, limits the workspace to packages whose paths match
+	// these patterns. Otherwise every package found is part of it.
+	Packages []string `yaml:"packages,omitempty"`
+	// Ignore lists patterns, in .gitignore syntax, of paths never searched
+	// for packages
+	Ignore   []string `yaml:"ignore,omitempty"`
 	packages []Package
 }
 
@@ -64,12 +72,19 @@ func (w Workspace) RunningContainers(ctx context.Context) ([]*runtime.ContainerT
 	return result, nil
 }
 
-func (w Workspace) ExecutePackage(ctx context.Context, p Package) error {
-	if runtimeCtx, err := w.execRuntimeContext(ctx); err != nil {
+func (w Workspace) ExecutePackage(ctx context.Context, p Package, flags ExecFlags) error {
+	if !flags.SkipBuild {
+		if err := p.BuildForExec(ctx); err != nil {
+			return err
+		}
+	}
+
+	runtimeCtx, err := w.execRuntimeContext(ctx)
+	if err != nil {
 		return err
-	} else {
-		return p.Execute(ctx, runtimeCtx)
 	}
+	defer shutdownRuntime(runtimeCtx)
+	return p.Execute(ctx, runtimeCtx, flags)
 }
 
 func (w Workspace) execRuntimeContext(ctx context.Context) (*runtime.Runtime, error) {
@@ -81,6 +96,14 @@ func (w Workspace) execRuntimeContext(ctx context.Context) (*runtime.Runtime, er
 	return runtimeCtx, nil
 }
 
+// shutdownRuntime removes the containers of a runtime once yb is done with
+// them. It runs even when ctx was cancelled by an interrupt.
+func shutdownRuntime(runtimeCtx *runtime.Runtime) {
+	if err := runtimeCtx.Shutdown(context.Background()); err != nil {
+		log.Warnf("Unable to shut down runtime %s: %v", runtimeCtx.Identifier, err)
+	}
+}
+
 func (w Workspace) Name() string {
 	_, name := filepath.Split(w.Path)
 	return name
@@ -182,37 +205,99 @@ func loadWorkspaceFromConfigYaml(configFile string, path string) (Workspace, err
 	workspace.Path = path
 
 	// Always load packages
-	globStr := filepath.Join(path, "*")
-	files, err := filepath.Glob(globStr)
+	if err := workspace.findPackages(); err != nil {
+		return Workspace{}, err
+	}
+
+	return workspace, nil
+}
+
+// findPackages looks for directories holding a build manifest anywhere
+// under the workspace and loads them as its packages, named by their path
+// relative to the workspace, like services/api. Hidden directories, the
+// build root, paths matching the ignore list and whatever git ignores aren't
+// searched. If the
+// workspace lists its packages, only those are loaded, and each entry has
+// to match at least one.
+func (w *Workspace) findPackages() error {
+	ignore := parseIgnoreRules(w.Ignore)
+	buildRoot := filepath.Join(w.Path, "build")
+	matched := make([]bool, len(w.Packages))
+
+	prefix, base, err := repoIgnoreRules(w.Path)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Unable to search for packages: %v", err)
 	}
+	// .gitignore rules that apply to the entries of each directory, by its
+	// path relative to the workspace
+	gitIgnore := make(map[string]ignoreList)
+
+	err = filepath.Walk(w.Path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("Unable to search for packages: %v", err)
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if p == w.Path {
+			gitIgnore["."], err = withIgnoreFile(base, p, prefix)
+			return err
+		}
 
-	for _, f := range files {
-		fi, err := os.Stat(f)
+		rel, err := filepath.Rel(w.Path, p)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		inherited := gitIgnore[path.Dir(rel)]
+		name := path.Join(prefix, rel)
+		if strings.HasPrefix(info.Name(), ".") || p == buildRoot || ignore.ignored(rel, true) || inherited.ignored(name, true) {
+			return filepath.SkipDir
+		}
+		if gitIgnore[rel], err = withIgnoreFile(inherited, p, name); err != nil {
+			return fmt.Errorf("Unable to search for packages: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(p, MANIFEST_FILE)); os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Unable to check for a package in %s: %v", rel, err)
 		}
-		if fi.IsDir() {
-			_, pkgName := filepath.Split(f)
-			pkgPath := f
-			if !strings.HasPrefix(pkgName, ".") {
-				pkg, err := LoadPackage(pkgName, pkgPath)
-				if err != nil {
-					if err == ErrNoManifestFile {
-						log.Debugf("No manifest file found for %s", pkgName)
-					} else {
-						log.Errorf("Error loading package '%s': %v", pkgName, err)
-					}
-				} else {
-					pkg.Workspace = &workspace
-					workspace.packages = append(workspace.packages, pkg)
+
+		if len(w.Packages) > 0 {
+			listed := false
+			for i, pattern := range w.Packages {
+				if matchGlob(strings.Trim(pattern, "/"), rel) {
+					matched[i] = true
+					listed = true
 				}
 			}
+			if !listed {
+				log.Debugf("Skipping package %s, it isn't listed in the workspace's packages", rel)
+				return nil
+			}
+		}
+
+		pkg, err := LoadPackage(rel, p)
+		if err != nil {
+			log.Errorf("Error loading package '%s': %v", rel, err)
+			return nil
 		}
+		pkg.Workspace = w
+		w.packages = append(w.packages, pkg)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	return workspace, nil
+	for i, pattern := range w.Packages {
+		if !matched[i] {
+			return fmt.Errorf("No package in the workspace matches '%s'", pattern)
+		}
+	}
+
+	return nil
 }
 
 func LoadWorkspace() (Workspace, error) {
@@ -244,7 +329,7 @@ func LoadWorkspace() (Workspace, error) {
 		log.Debugf("Loading workspace from config file: %s", configFile)
 		w, err = loadWorkspaceFromConfigYaml(configFile, workspacePath)
 		if err != nil {
-			return Workspace{}, fmt.Errorf("unable to workspace config file: %s", configFile)
+			return Workspace{}, fmt.Errorf("unable to load workspace config file %s: %v", configFile, err)
 		}
 		if err = validWorkspaceConfig(w); err != nil {
 			return Workspace{}, err
@@ -281,16 +366,13 @@ func validWorkspaceConfig(workspace Workspace) error {
 		}
 
 		if valid = len(pkg.Manifest.Exec.Commands) > 0; !valid {
-			if pkg.Manifest.Exec.Environment == nil {
-				pkg.Manifest.Exec.Environment = make(map[string][]string)
-			}
 			// No Exec Phase defined, not required, but `yb run should still work`
-			pkg.Manifest.Exec.Environment["default"] = pkg.Manifest.Build.Environment
-			if len(pkg.Manifest.Exec.Environment["default"]) == 0 {
+			pkg.Manifest.Exec.Environment = pkg.Manifest.Build.Environment
+			if len(pkg.Manifest.Exec.Environment[DefaultEnvironment]) == 0 {
 				if valid = len(pkg.Manifest.BuildTargets) > 0; !valid {
 					return fmt.Errorf("no exec nor build target defined, won't be able to `yb run` or `yb exec`")
 				}
-				pkg.Manifest.Exec.Environment["default"] = pkg.Manifest.BuildTargets[0].Environment
+				pkg.Manifest.Exec.Environment = pkg.Manifest.BuildTargets[0].Environment
 			}
 		}
 
@@ -0,0 +1,134 @@
+package workspace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testTree creates a workspace directory holding config.yml and a package
+// in each of pkgDirs.
+func testTree(t *testing.T, config string, pkgDirs ...string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "yb-workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.yml"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkgDir := range pkgDirs {
+		p := filepath.Join(dir, filepath.FromSlash(pkgDir))
+		if err := os.MkdirAll(p, 0700); err != nil {
+			t.Fatal(err)
+		}
+		manifest := "build_targets:\n  - name: default\n    commands:\n      - echo hi\n"
+		if err := ioutil.WriteFile(filepath.Join(p, ".yourbase.yml"), []byte(manifest), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func packageNames(w Workspace) []string {
+	names := make([]string, 0)
+	for _, pkg := range w.PackageList() {
+		names = append(names, pkg.Name)
+	}
+	return names
+}
+
+func TestLoadWorkspaceFromConfigYaml(t *testing.T) {
+	dir := testTree(t, "target: api\nignore:\n  - vendor/\n",
+		"api", "services/billing", "services/web/frontend", "vendor/lib", ".hidden/pkg", "build/pkg")
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "docs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := loadWorkspaceFromConfigYaml(filepath.Join(dir, "config.yml"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"api", "services/billing", "services/web/frontend"}
+	if names := packageNames(w); !reflect.DeepEqual(names, want) {
+		t.Errorf("packages = %v, want %v", names, want)
+	}
+
+	pkg, err := w.PackageByName("services/billing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "services", "billing"); pkg.Path() != want {
+		t.Errorf("path = %s, want %s", pkg.Path(), want)
+	}
+}
+
+func TestLoadWorkspacePackageList(t *testing.T) {
+	dir := testTree(t, "target: api\npackages:\n  - api\n  - services/*\n",
+		"api", "services/billing", "services/web", "tools/lint")
+	defer os.RemoveAll(dir)
+
+	w, err := loadWorkspaceFromConfigYaml(filepath.Join(dir, "config.yml"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"api", "services/billing", "services/web"}
+	if names := packageNames(w); !reflect.DeepEqual(names, want) {
+		t.Errorf("packages = %v, want %v", names, want)
+	}
+
+	dir2 := testTree(t, "target: api\npackages:\n  - api\n  - missing\n", "api")
+	defer os.RemoveAll(dir2)
+	if _, err := loadWorkspaceFromConfigYaml(filepath.Join(dir2, "config.yml"), dir2); err == nil {
+		t.Error("loading succeeded with a listed package that doesn't exist")
+	}
+}
+
+func TestLoadWorkspaceGitIgnore(t *testing.T) {
+	dir := testTree(t, "target: api\n",
+		"api", "node_modules/dep", "web/app", "web/app/node_modules/dep", "web/dist/pkg", "generated/pkg")
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		".gitignore":        "node_modules/\n",
+		"web/.gitignore":    "/dist\n",
+		".git/info/exclude": "generated\n",
+	}
+	for name, contents := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := loadWorkspaceFromConfigYaml(filepath.Join(dir, "config.yml"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"api", "web/app"}
+	if names := packageNames(w); !reflect.DeepEqual(names, want) {
+		t.Errorf("packages = %v, want %v", names, want)
+	}
+}
+
+func TestLoadWorkspaceStatError(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any directory")
+	}
+	dir := testTree(t, "target: api\n", "api", "locked/pkg")
+	defer os.RemoveAll(dir)
+	locked := filepath.Join(dir, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0700)
+
+	if _, err := loadWorkspaceFromConfigYaml(filepath.Join(dir, "config.yml"), dir); err == nil {
+		t.Error("loading succeeded with an unreadable directory")
+	}
+}